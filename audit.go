@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	gorilla_context "github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+const (
+	authMethodSession = "session"
+	authMethodBasic   = "basic"
+	authMethodBearer  = "bearer"
+)
+
+type AuditEntry struct {
+	Id           int                 `json:"id"`
+	DateCreated  time.Time           `json:"dateCreated"`
+	UserId       int                 `json:"userId"`
+	ContractorId int                 `json:"contractorId"`
+	SupplierId   int                 `json:"supplierId"`
+	AuthMethod   string              `json:"authMethod"`
+	ApiLogin     string              `json:"apiLogin"`
+	IP           string              `json:"ip"`
+	Method       string              `json:"method"`
+	Endpoint     string              `json:"endpoint"`
+	Params       map[string][]string `json:"params"`
+	Status       int                 `json:"status"`
+	ResponseSize int                 `json:"responseSize"`
+	DurationMs   int                 `json:"durationMs"`
+	// id of superuser who made the call acting as UserId
+	ImpersonatedBy *int `json:"impersonatedBy"`
+}
+
+// writes audit entries to crutch DB in background, so that API calls do not wait for that
+type AuditLog struct {
+	crutchDB *CrutchDBHelper
+	entries  chan AuditEntry
+}
+
+func initAuditLog(crutchDB *CrutchDBHelper, retention time.Duration) *AuditLog {
+	al := AuditLog{crutchDB, make(chan AuditEntry, 1000)}
+
+	go func() {
+		for e := range al.entries {
+			err := al.crutchDB.saveAuditEntry(context.Background(), e)
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+
+	go func() {
+		// old entries are removed on start, then once a day
+		al.removeExpired(retention)
+		for range time.Tick(24 * time.Hour) {
+			al.removeExpired(retention)
+		}
+	}()
+
+	return &al
+}
+
+func (al *AuditLog) removeExpired(retention time.Duration) {
+	deleted, err := al.crutchDB.deleteAuditEntriesBefore(context.Background(), time.Now().Add(-retention))
+	if err != nil {
+		log.Error(err)
+	} else if deleted > 0 {
+		log.Info("Removed ", deleted, " audit entries older than ", retention)
+	}
+}
+
+func (al *AuditLog) record(e AuditEntry) {
+	select {
+	case al.entries <- e:
+	default:
+		log.Warn("Audit log queue is full, dropping entry ", e)
+	}
+}
+
+type auditRespWr struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *auditRespWr) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditRespWr) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.size += n
+	return n, err
+}
+
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return r.URL.Path
+}
+
+// records every authenticated call, both UI sessions and API clients
+func (al *AuditLog) auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		ui := gorilla_context.Get(r, "UserInfo").(UserInfo)
+
+		start := time.Now()
+		aw := &auditRespWr{ResponseWriter: w}
+		next.ServeHTTP(aw, r)
+
+		al.record(newAuditEntry(r, ui, start, aw.status, aw.size))
+	})
+}
+
+// records request rejected by authentication, before it reached the handler
+func (al *AuditLog) recordRejection(r *http.Request, ui UserInfo, status int) {
+	al.record(newAuditEntry(r, ui, time.Now(), status, 0))
+}
+
+func newAuditEntry(r *http.Request, ui UserInfo, start time.Time, status int, size int) AuditEntry {
+	var impersonatedBy *int
+	if ui.ImpersonatedBy != nil {
+		impersonatedBy = &ui.ImpersonatedBy.Id
+	}
+
+	return AuditEntry{
+		DateCreated:    start,
+		UserId:         ui.Id,
+		ContractorId:   ui.ContractorId,
+		SupplierId:     ui.SupplierId,
+		AuthMethod:     ui.AuthMethod,
+		ApiLogin:       ui.ApiLogin,
+		IP:             clientIP(r),
+		Method:         r.Method,
+		Endpoint:       routeTemplate(r),
+		Params:         r.URL.Query(),
+		Status:         status,
+		ResponseSize:   size,
+		DurationMs:     int(time.Since(start).Milliseconds()),
+		ImpersonatedBy: impersonatedBy,
+	}
+}
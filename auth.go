@@ -1,49 +1,73 @@
 package main
 
 import (
-	"context"
-	"crypto/sha256"
-	"crypto/subtle"
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
-	"regexp"
 	"time"
 
 	gorilla_context "github.com/gorilla/context"
+	"github.com/gorilla/csrf"
 )
 
 type UserInfo struct {
-	Id             int    `json:"id"`
-	Name           string `json:"name"`
-	Email          string `json:"email"`
-	Admin          bool   `json:"admin"`
-	Staff          bool   `json:"staff"`
-	CompanyAdmin   bool   `json:"company_admin"`
-	CanReadOrders  bool   `json:"can_read_orders"`
-	CanReadBuyers  bool   `json:"can_read_buyers"`
-	CanReadSellers bool   `json:"can_read_sellers"`
-	ContractorName string `json:"contractor"`
-	ContractorId   int    `json:"contractor_id"`
-	SupplierName   string `json:"supplier"`
-	SupplierId     int    `json:"supplier_id"`
-	CompareList    string `json:"compare_list"`
+	Id             int      `json:"id"`
+	Name           string   `json:"name"`
+	Email          string   `json:"email"`
+	Admin          bool     `json:"admin"`
+	Staff          bool     `json:"staff"`
+	CompanyAdmin   bool     `json:"company_admin"`
+	CanReadOrders  bool     `json:"can_read_orders"`
+	CanReadBuyers  bool     `json:"can_read_buyers"`
+	CanReadSellers bool     `json:"can_read_sellers"`
+	ContractorName string   `json:"contractor"`
+	ContractorId   int      `json:"contractor_id"`
+	SupplierName   string   `json:"supplier"`
+	SupplierId     int      `json:"supplier_id"`
+	CompareList    string   `json:"compare_list"`
+	AuthMethod     string   `json:"auth_method,omitempty"`
+	ApiLogin       string   `json:"api_login,omitempty"`
+	Scopes         []string `json:"scopes,omitempty"`
+	Capabilities   []string `json:"capabilities"`
+	// API credentials of contractor or supplier company, Id is 0
+	ServiceAccount bool `json:"service_account,omitempty"`
+	// CIDRs API credentials are restricted to
+	AllowedIPs []string `json:"allowed_ips,omitempty"`
+	// set when superuser acts as this user
+	ImpersonatedBy *Impersonator `json:"impersonated_by,omitempty"`
+	// version of API credentials, access token is valid only while it does not change
+	CredentialsVersion int64 `json:"-"`
 }
 
+// scopes that might be granted to API key, key without scopes has full access
+const (
+	scopeOrdersRead       = "orders:read"
+	scopeProductsSearch   = "products:search"
+	scopeCounterpartsRead = "counterparts:read"
+)
+
+var apiScopes = []string{scopeOrdersRead, scopeProductsSearch, scopeCounterpartsRead}
+
 type City struct {
 	Id   int    `json:"id"`
 	Name string `json:"name"`
 }
 
 type AuthMiddleware struct {
-	prodDB   *ProdDBHelper
-	crutchDB *CrutchDBHelper
+	prodDB           *ProdDBHelper
+	crutchDB         *CrutchDBHelper
+	cache            *UserInfoCache
+	tokens           *tokenConfig
+	djangoSecretKeys []string
+	limiter          *RateLimiter
+	audit            *AuditLog
+	permissions      *PermissionResolver
+	signer           *requestSigner
 }
 
-func initAuthMiddleware(db *ProdDBHelper, crutchDB *CrutchDBHelper) *AuthMiddleware {
+func initAuthMiddleware(db *ProdDBHelper, crutchDB *CrutchDBHelper, cache *UserInfoCache, tokens *tokenConfig, djangoSecretKeys []string, limiter *RateLimiter, audit *AuditLog, permissions *PermissionResolver, signer *requestSigner) *AuthMiddleware {
 
-	au := AuthMiddleware{db, crutchDB}
+	au := AuthMiddleware{db, crutchDB, cache, tokens, djangoSecretKeys, limiter, audit, permissions, signer}
 
 	return &au
 }
@@ -58,14 +82,38 @@ func (auth *AuthMiddleware) authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer TimeTrack("Processing "+r.URL.Path, time.Now())
 
-		ui, err := auth.checkBasicAuth(w, r)
-		if err != nil || ui == nil {
+		// bearer tokens are self-contained, no need to load user info
+		if token, ok := bearerToken(r); ok {
+			ui, err := auth.checkBearerToken(w, r, token)
+			if err == nil {
+				err = auth.impersonate(w, r, ui)
+			}
+			if err == nil {
+				next.ServeHTTP(w, r)
+			}
+			return
+		}
+
+		// failed basic auth does not fall back to session
+		var ui *UserInfo
+		var err error
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			ui, err = auth.checkClientCert(w, r)
+		} else if isSignedRequest(r) {
+			ui, err = auth.checkSignature(w, r)
+		} else if _, _, ok := r.BasicAuth(); ok {
+			ui, err = auth.checkBasicAuth(w, r)
+		} else {
 			ui, err = auth.validateSession(w, r)
 		}
 
 		if err == nil && ui != nil {
 
-			err = auth.loadUserInfo(w, r, ui)
+			err = auth.loadUserInfo(w, r, ui, true)
+
+			if err == nil {
+				err = auth.impersonate(w, r, ui)
+			}
 
 			if err == nil {
 				next.ServeHTTP(w, r)
@@ -74,30 +122,120 @@ func (auth *AuthMiddleware) authMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// CSRF protection is needed only for browser sessions relying on cookies,
+// API clients authenticate every request explicitly
+func skipCSRFForApiClients(tokenPath string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientCert := r.TLS != nil && len(r.TLS.PeerCertificates) > 0
+			if r.Header.Get("Authorization") != "" || clientCert || r.URL.Path == tokenPath {
+				r = csrf.UnsafeSkipCheck(r)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 func (auth *AuthMiddleware) checkBasicAuth(w http.ResponseWriter, r *http.Request) (*UserInfo, error) {
 	username, password, ok := r.BasicAuth()
-	if ok {
+	if !ok {
+		return nil, basicAuthFailed(w, fmt.Errorf("No auth headers"), http.StatusUnauthorized, 0)
+	}
 
-		userId, expectedPassword, err := auth.crutchDB.getUserCredsFromApiLogin(r.Context(), username)
+	ip := clientIP(r)
 
-		if err != nil {
-			return nil, fmt.Errorf("Failed to find username %s", username)
+	lockedUntil, failures, err := auth.crutchDB.getAuthLock(r.Context(), username, ip)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+	if lockedUntil != nil {
+		err = fmt.Errorf("Too many failed attempts, API login %s is locked until %v", username, lockedUntil.Format(time.RFC3339))
+		return nil, basicAuthFailed(w, err, http.StatusTooManyRequests, time.Until(*lockedUntil))
+	}
+
+	creds, err := auth.crutchDB.getUserCredsFromApiLogin(r.Context(), username)
+
+	passwordHash := dummyPasswordHash
+	var userId *int
+	if err == nil {
+		passwordHash = creds.PasswordHash
+		if creds.UserId != 0 {
+			userId = &creds.UserId
 		}
+	}
 
-		passwordHash := sha256.Sum256([]byte(password))
+	// previous password is accepted during grace period after rotation
+	valid := checkApiPassword(passwordHash, password)
+	previous := false
+	if !valid && err == nil && creds.PreviousPasswordHash != nil {
+		valid = checkApiPassword(*creds.PreviousPasswordHash, password)
+		previous = valid
+	}
 
-		expectedPasswordHash := sha256.Sum256([]byte(expectedPassword))
+	if !valid || err != nil {
+		auth.registerBasicAuthFailure(r.Context(), username, ip, userId)
+		return nil, basicAuthFailed(w, fmt.Errorf("Wrong API login or password"), http.StatusUnauthorized, 0)
+	}
 
-		passwordMatch := (subtle.ConstantTimeCompare(passwordHash[:], expectedPasswordHash[:]) == 1)
+	ui := creds.userInfo(authMethodBasic, username)
+	err = auth.checkAllowedIP(w, r, ui)
+	if err != nil {
+		return nil, err
+	}
 
-		if !passwordMatch {
-			return nil, fmt.Errorf("Password is wrong")
+	// most logins have no failures, so there is nothing to delete
+	if failures > 0 {
+		err = auth.crutchDB.resetAuthFailures(r.Context(), authFailureKindLogin, username)
+		if err != nil {
+			log.Error(err)
 		}
+	}
 
-		log.Info("BasicAuth: userId ", userId)
-		return &UserInfo{Id: userId}, nil
+	err = auth.crutchDB.markApiPasswordUsed(r.Context(), username, previous)
+	if err != nil {
+		log.Error(err)
+	}
+
+	if previous {
+		log.Warn("API login ", username, " used previous password, it expires after grace period")
 	}
-	return nil, fmt.Errorf("No auth headers")
+
+	log.Info("BasicAuth: userId ", creds.UserId, ", login ", username)
+	return ui, nil
+}
+
+// API credentials may be restricted to CIDRs, rejected requests are recorded in audit log
+func (auth *AuthMiddleware) checkAllowedIP(w http.ResponseWriter, r *http.Request, ui *UserInfo) error {
+	if len(ui.AllowedIPs) == 0 {
+		return nil
+	}
+
+	ip := clientIP(r)
+	nets, err := parseCIDRs(ui.AllowedIPs)
+	if err != nil {
+		log.Error(err)
+	} else if parsed := net.ParseIP(ip); parsed != nil && ipInNets(parsed, nets) {
+		return nil
+	}
+
+	err = fmt.Errorf("API login %s is not allowed from %s", ui.ApiLogin, ip)
+	log.Error(err)
+	auth.audit.recordRejection(r, *ui, http.StatusForbidden)
+	http.Error(w, err.Error(), http.StatusForbidden)
+	return err
+}
+
+// user info as far as it is known from credentials, the rest is filled by loadUserInfo
+func (creds *ApiLoginCreds) userInfo(authMethod string, login string) *UserInfo {
+	ui := UserInfo{Id: creds.UserId, AuthMethod: authMethod, ApiLogin: login, Scopes: creds.Scopes, AllowedIPs: creds.AllowedIPs, CredentialsVersion: creds.DateUpdated.UnixNano()}
+	if creds.UserId == 0 {
+		ui.ServiceAccount = true
+		ui.ContractorId = creds.ContractorId
+		ui.SupplierId = creds.SupplierId
+	}
+	return &ui
 }
 
 func (auth *AuthMiddleware) validateSession(w http.ResponseWriter, r *http.Request) (*UserInfo, error) {
@@ -115,7 +253,8 @@ func (auth *AuthMiddleware) validateSession(w http.ResponseWriter, r *http.Reque
 	log.Trace("Getting user info for sessionid ", sessionKey)
 
 	var encodedSessionData string
-	err = auth.prodDB.pool.QueryRow(context.Background(), "select session_data from django_session where session_key=$1", sessionKey).Scan(&encodedSessionData)
+	var expireDate time.Time
+	err = auth.prodDB.pool.QueryRow(r.Context(), "select session_data, expire_date from django_session where session_key=$1", sessionKey).Scan(&encodedSessionData, &expireDate)
 	if err != nil {
 		err = fmt.Errorf("Session does not exist: %v", err)
 		log.Error(err)
@@ -123,7 +262,14 @@ func (auth *AuthMiddleware) validateSession(w http.ResponseWriter, r *http.Reque
 		return nil, err
 	}
 
-	decodedSessionData, err := base64.StdEncoding.DecodeString(encodedSessionData)
+	if expireDate.Before(time.Now()) {
+		err = fmt.Errorf("Session has expired at %v", expireDate)
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, err
+	}
+
+	session, err := decodeDjangoSession(encodedSessionData, auth.djangoSecretKeys)
 	if err != nil {
 		err = fmt.Errorf("Failed to decode session data: %v", err)
 		log.Error(err)
@@ -131,22 +277,72 @@ func (auth *AuthMiddleware) validateSession(w http.ResponseWriter, r *http.Reque
 		return nil, err
 	}
 
-	re := regexp.MustCompile(`[^{]*({.*})$`)
-	jsonSessionData := re.ReplaceAllString(string(decodedSessionData), "${1}")
-
-	log.Info("SessionData: ", jsonSessionData)
-	var sessionData struct {
-		UserID      int    `json:"_auth_user_id"`
-		CompareList string `json:"compare_list"`
+	// the same check django.contrib.auth.get_user does, session becomes invalid once password is changed;
+	// the hash is salted with secret key, so it cannot be checked without one
+	if session.AuthUserHash != "" && len(auth.djangoSecretKeys) > 0 {
+		var passwordHash string
+		err = auth.prodDB.pool.QueryRow(r.Context(), "select password from core_user where id=$1", session.UserId).Scan(&passwordHash)
+		if err != nil || !checkDjangoSessionAuthHash(session.AuthUserHash, passwordHash, auth.djangoSecretKeys) {
+			err = fmt.Errorf("Session of user %v is not valid anymore", session.UserId)
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return nil, err
+		}
 	}
-	json.Unmarshal([]byte(jsonSessionData), &sessionData)
 
-	log.Info("Session: userId ", sessionData.UserID)
+	log.Info("Session: userId ", session.UserId)
 
-	return &UserInfo{Id: sessionData.UserID, CompareList: sessionData.CompareList}, nil
+	return &UserInfo{Id: session.UserId, AuthMethod: authMethodSession, CompareList: session.CompareList}, nil
 }
 
-func (auth *AuthMiddleware) loadUserInfo(w http.ResponseWriter, r *http.Request, ui *UserInfo) error {
+func (auth *AuthMiddleware) userInfoCacheKey(r *http.Request, ui *UserInfo) string {
+	if ui.ApiLogin != "" {
+		return apiLoginCacheKey(ui.ApiLogin)
+	}
+
+	sessionCookie, err := r.Cookie("sessionid")
+	if err != nil {
+		return ""
+	}
+	return sessionCacheKey(sessionCookie.Value)
+}
+
+func (auth *AuthMiddleware) loadUserInfo(w http.ResponseWriter, r *http.Request, ui *UserInfo, useCache bool) error {
+
+	cacheKey := ""
+	if useCache {
+		cacheKey = auth.userInfoCacheKey(r, ui)
+	}
+
+	if cacheKey != "" {
+		if cached, found := auth.cache.get(cacheKey); found {
+			// these come from credentials or session, not from prod DB
+			cached.AuthMethod = ui.AuthMethod
+			cached.ApiLogin = ui.ApiLogin
+			cached.Scopes = ui.Scopes
+			cached.AllowedIPs = ui.AllowedIPs
+			cached.CompareList = ui.CompareList
+			*ui = cached
+
+			gorilla_context.Set(r, "UserInfo", *ui)
+			return nil
+		}
+	}
+
+	if ui.ServiceAccount {
+		err := auth.loadServiceAccountInfo(r, ui)
+		if err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return err
+		}
+
+		if cacheKey != "" {
+			auth.cache.set(cacheKey, *ui)
+		}
+		gorilla_context.Set(r, "UserInfo", *ui)
+		return nil
+	}
 
 	udi, err := auth.prodDB.getUserInfo(ui.Id)
 
@@ -183,9 +379,10 @@ func (auth *AuthMiddleware) loadUserInfo(w http.ResponseWriter, r *http.Request,
 	ui.Admin = udi.is_superuser
 	ui.Staff = udi.is_staff
 	ui.CompanyAdmin = udi.is_company_admin
-	ui.CanReadOrders = udi.can_read_orders
-	ui.CanReadBuyers = udi.can_read_buyers
-	ui.CanReadSellers = udi.can_read_sellers
+	ui.Capabilities = auth.permissions.resolve(udi)
+	ui.CanReadOrders = contains(ui.Capabilities, capReadAllOrders)
+	ui.CanReadBuyers = contains(ui.Capabilities, capReadBuyers)
+	ui.CanReadSellers = contains(ui.Capabilities, capReadSellers)
 	ui.ContractorName = udi.contractor_name
 	ui.ContractorId = udi.contractor_id
 	ui.SupplierName = udi.supplier_name
@@ -205,7 +402,38 @@ func (auth *AuthMiddleware) loadUserInfo(w http.ResponseWriter, r *http.Request,
 
 	log.Info("User ", fmt.Sprintf("%+v", ui))
 
+	if cacheKey != "" {
+		auth.cache.set(cacheKey, *ui)
+	}
+
 	gorilla_context.Set(r, "UserInfo", *ui)
 
 	return nil
 }
+
+// service account acts as company admin of its company, limited by its scopes
+func (auth *AuthMiddleware) loadServiceAccountInfo(r *http.Request, ui *UserInfo) error {
+	companyName, err := auth.prodDB.getCompanyName(r.Context(), ui.ContractorId, ui.SupplierId)
+	if err != nil {
+		return err
+	}
+
+	ui.Name = companyName + " (" + ui.ApiLogin + ")"
+	ui.CompanyAdmin = true
+	if ui.SupplierId != 0 {
+		ui.SupplierName = companyName
+	} else {
+		ui.ContractorName = companyName
+	}
+
+	ui.Capabilities = auth.permissions.resolve(&UserDBInfo{
+		is_company_admin: true,
+		verified:         true,
+		contractor_id:    ui.ContractorId,
+		supplier_id:      ui.SupplierId,
+	})
+
+	log.Info("Service account ", fmt.Sprintf("%+v", ui))
+
+	return nil
+}
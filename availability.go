@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+const (
+	availabilityBatchSize = 1000
+	// set in _meta of index once the whole catalog is synced, see productMapping.StockSynced
+	availabilitySyncedMeta = "availability_synced"
+)
+
+// fields of ProductAvailability, their mapping is put into index before the first sync
+var stockMappingFields = []string{"visible", "has_category", "enable_preorder", "price", "supplier", "availability"}
+
+// availability of product in one visible warehouse of its supplier
+type WarehouseAvailability struct {
+	WarehouseId int     `json:"warehouse_id"`
+	Cities      []int   `json:"cities"` // delivery cities of warehouse
+	Rest        float64 `json:"rest"`
+}
+
+type ProductSupplier struct {
+	Id      int    `json:"id"`
+	Name    string `json:"name"`
+	Blocked bool   `json:"blocked"` // either orders or work of supplier are blocked
+}
+
+// part of product document in ES which search filters by, it is kept in sync with prod DB by AvailabilitySync;
+// visible is false for deleted, reference, not placed and hidden products and for products in hidden categories
+type ProductAvailability struct {
+	Id             int                     `json:"-"`
+	Visible        bool                    `json:"visible"`
+	HasCategory    bool                    `json:"has_category"`
+	EnablePreorder bool                    `json:"enable_preorder"`
+	Price          *float64                `json:"price"` // null when price is not set, such products are sorted last
+	Supplier       ProductSupplier         `json:"supplier"`
+	Availability   []WarehouseAvailability `json:"availability"`
+}
+
+// availability of user, search does the same filtering in ES that getProductEntries does in prod DB
+type StockFilter struct {
+	Customer    bool  // customers see only products with category, in stock or for preorder, deliverable to their cities
+	Cities      []int // consignee cities of customer
+	CityId      int
+	InStockOnly bool
+	SupplierId  int    // suppliers see only their products
+	Supplier    string // part of supplier name
+}
+
+func newStockFilter(userInfo UserInfo, cities []City, query *SearchQuery) *StockFilter {
+	f := StockFilter{
+		Customer:    !userInfo.Admin && userInfo.SupplierId == 0,
+		CityId:      query.CityID,
+		InStockOnly: query.InStockOnly,
+		SupplierId:  userInfo.SupplierId,
+	}
+
+	if f.Customer {
+		for _, city := range cities {
+			f.Cities = append(f.Cities, city.Id)
+		}
+	}
+
+	if f.SupplierId == 0 {
+		f.Supplier = query.Supplier
+	}
+
+	return &f
+}
+
+func nestedAvailability(conditions []interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"nested": map[string]interface{}{
+			"path": "availability",
+			"query": map[string]interface{}{
+				"bool": map[string]interface{}{"filter": conditions},
+			},
+		},
+	}
+}
+
+func term(field string, value interface{}) map[string]interface{} {
+	return map[string]interface{}{"term": map[string]interface{}{field: value}}
+}
+
+// conditions on warehouse, product has to have rest in such warehouse
+func (f *StockFilter) warehouseConditions() []interface{} {
+	warehouse := make([]interface{}, 0)
+
+	if f.Customer {
+		warehouse = append(warehouse, map[string]interface{}{
+			"terms": map[string]interface{}{"availability.cities": f.Cities},
+		})
+	}
+
+	if f.CityId > 0 {
+		warehouse = append(warehouse, term("availability.cities", f.CityId))
+	}
+
+	return warehouse
+}
+
+// stock filters, none until index has availability synced; getProductEntries still filters by stock
+// in prod DB then, so pages are just shorter
+func (es *ElasticHelper) stockFilters(stock *StockFilter) []interface{} {
+	if !es.productMapping().StockSynced {
+		return []interface{}{}
+	}
+	return stock.filters()
+}
+
+func (f *StockFilter) filters() []interface{} {
+	filters := []interface{}{term("visible", true)}
+	warehouse := f.warehouseConditions()
+
+	if f.Customer {
+		filters = append(filters, term("has_category", true))
+	}
+
+	if f.SupplierId != 0 {
+		filters = append(filters, term("supplier.id", f.SupplierId))
+	} else {
+		filters = append(filters, term("supplier.blocked", false))
+		if f.Supplier != "" {
+			filters = append(filters, map[string]interface{}{
+				"match_phrase": map[string]interface{}{"supplier.name": f.Supplier},
+			})
+		}
+	}
+
+	inStock := append(append(make([]interface{}, 0), warehouse...), map[string]interface{}{
+		"range": map[string]interface{}{"availability.rest": map[string]interface{}{"gt": 0}},
+	})
+
+	switch {
+	case f.InStockOnly:
+		filters = append(filters, nestedAvailability(inStock))
+	case f.Customer:
+		filters = append(filters, map[string]interface{}{
+			"bool": map[string]interface{}{
+				"should": []interface{}{
+					nestedAvailability(inStock),
+					map[string]interface{}{
+						"bool": map[string]interface{}{
+							"filter": []interface{}{term("enable_preorder", true), nestedAvailability(warehouse)},
+						},
+					},
+				},
+				"minimum_should_match": 1,
+			},
+		})
+	case len(warehouse) > 0:
+		filters = append(filters, nestedAvailability(warehouse))
+	}
+
+	return filters
+}
+
+// periodically copies availability from prod DB to ES, only changed products are updated
+type AvailabilitySync struct {
+	es     *ElasticHelper
+	prodDB *ProdDBHelper
+	hashes map[int]uint64
+}
+
+// zero interval disables sync, it is to be enabled on one instance only, since every sync reads the whole catalog
+func initAvailabilitySync(es *ElasticHelper, prodDB *ProdDBHelper, interval time.Duration) *AvailabilitySync {
+	as := AvailabilitySync{es, prodDB, make(map[int]uint64)}
+	if interval == 0 {
+		log.Warn("Availability sync is disabled, search relies on other instance to keep stock in index up to date")
+		return &as
+	}
+
+	go func() {
+		// partial updates of dynamically mapped index would map availability as object, nested queries need it nested
+		if err := es.putStockMapping(context.Background()); err != nil {
+			log.Error(err, ", search will not filter by stock in ES until full reindex")
+		}
+
+		// index is synced on start, then every interval
+		as.syncLogged()
+		for range time.Tick(interval) {
+			as.syncLogged()
+		}
+	}()
+
+	return &as
+}
+
+func (as *AvailabilitySync) syncLogged() {
+	err := as.sync(context.Background())
+	if err != nil {
+		log.Error("Availability sync failed: ", err)
+	}
+}
+
+// adds mapping of stock fields from conf/elastic/product_index.json to index behind alias,
+// fails when the index already has them mapped otherwise
+func (es *ElasticHelper) putStockMapping(ctx context.Context) error {
+	var settings struct {
+		Mappings struct {
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"mappings"`
+	}
+	if err := json.Unmarshal(productIndexSettings, &settings); err != nil {
+		return fmt.Errorf("Failed to parse product index settings: %v", err)
+	}
+
+	properties := make(map[string]interface{})
+	for _, field := range stockMappingFields {
+		properties[field] = settings.Mappings.Properties[field]
+	}
+
+	err := es.perform(ctx, "PUT", "/"+productIndex+"/_mapping", map[string]interface{}{"properties": properties}, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to put mapping of stock fields: %v", err)
+	}
+	return nil
+}
+
+func availabilityHash(p ProductAvailability) uint64 {
+	b, _ := json.Marshal(p)
+	h := fnv.New64a()
+	h.Write(b)
+	return h.Sum64()
+}
+
+func (as *AvailabilitySync) sync(ctx context.Context) error {
+	start := time.Now()
+	total, updated, missing := 0, 0, 0
+
+	for afterId := 0; ; {
+		batch, err := as.prodDB.getProductsAvailability(ctx, afterId, availabilityBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		afterId = batch[len(batch)-1].Id
+		total += len(batch)
+
+		docs := make([]bulkDoc, 0)
+		hashes := make(map[int]uint64)
+		for _, p := range batch {
+			h := availabilityHash(p)
+			if as.hashes[p.Id] != h {
+				docs = append(docs, bulkDoc{p.Id, p})
+				hashes[p.Id] = h
+			}
+		}
+		if len(docs) == 0 {
+			continue
+		}
+
+		failed, notFound, err := as.es.bulk(ctx, productIndex, "update", docs)
+		if err != nil {
+			return err
+		}
+		// failed products are retried on the next sync, products missing from index are not
+		for id, h := range hashes {
+			if !failed[id] {
+				as.hashes[id] = h
+			}
+		}
+		updated += len(docs) - len(failed) - notFound
+		missing += notFound
+	}
+
+	log.Info("Availability sync: updated ", updated, " of ", total, " products, ", missing, " not found in index, took ", time.Since(start))
+
+	// products failed now are retried by the next sync, the rest of catalog is filterable already
+	if !as.es.productMapping().StockSynced {
+		err := as.es.updateIndexMeta(ctx, productIndex, map[string]interface{}{availabilitySyncedMeta: true})
+		if err != nil {
+			return fmt.Errorf("Failed to mark index as synced: %v", err)
+		}
+		as.es.refreshMapping()
+	}
+	return nil
+}
+
+type ProductCategory struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type ProductProperty struct {
+	Property struct {
+		Id   int    `json:"id"`
+		Name string `json:"name"`
+	} `json:"property"`
+	Value string `json:"value"`
+}
+
+// product document of search index, mapping is in conf/elastic/product_index.json
+type ProductDocument struct {
+	ProductAvailability
+	Code           string            `json:"code"`
+	CodeNormalized string            `json:"code_normalized"` // see normalizeCode
+	Name           string            `json:"name"`
+	Description    string            `json:"description"`
+	Category       []ProductCategory `json:"category"`
+	Properties     []ProductProperty `json:"properties"`
+	DateModified   time.Time         `json:"date_modified"`
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const authMethodCertificate = "certificate"
+
+// client certificate registered for user, certificate is matched by SHA-256 fingerprint,
+// certificate registered by subject only is accepted with any fingerprint once it is verified by CA
+type ApiClientCert struct {
+	Id          int        `json:"id"`
+	Fingerprint *string    `json:"fingerprint"`
+	Subject     string     `json:"subject"`
+	Scopes      []string   `json:"scopes"`
+	NotAfter    *time.Time `json:"notAfter"`
+	DateCreated time.Time  `json:"dateCreated"`
+}
+
+func certFingerprint(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(h[:])
+}
+
+// certificate chain is already verified against TLS_CLIENT_CA by TLS listener,
+// here it is only mapped to user
+func (auth *AuthMiddleware) checkClientCert(w http.ResponseWriter, r *http.Request) (*UserInfo, error) {
+	cert := r.TLS.PeerCertificates[0]
+	fingerprint := certFingerprint(cert)
+	subject := cert.Subject.String()
+
+	creds, err := auth.crutchDB.getUserCredsFromClientCert(r.Context(), fingerprint, subject)
+	if err != nil {
+		err = fmt.Errorf("Client certificate %s (%s) is not registered: %v", subject, fingerprint, err)
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, err
+	}
+
+	log.Info("ClientCert: userId ", creds.UserId, ", subject ", subject)
+	return &UserInfo{Id: creds.UserId, AuthMethod: authMethodCertificate, ApiLogin: "cert:" + fingerprint, Scopes: creds.Scopes}, nil
+}
+
+type apiClientCertParams struct {
+	Certificate string   `json:"certificate"` // PEM
+	Fingerprint string   `json:"fingerprint"` // hex encoded SHA-256, colons are allowed
+	Subject     string   `json:"subject"`
+	Scopes      []string `json:"scopes"`
+}
+
+var fingerprintRe = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+func (mh *MethodHandlers) registerClientCert(ctx context.Context, userInfo UserInfo, params apiClientCertParams) (cert *ApiClientCert, err error, code int) {
+
+	for _, scope := range params.Scopes {
+		if !contains(apiScopes, scope) {
+			return nil, fmt.Errorf("Unknown scope %s, available scopes are %v", scope, apiScopes), http.StatusBadRequest
+		}
+	}
+
+	cert = &ApiClientCert{Subject: params.Subject, Scopes: params.Scopes}
+
+	if params.Certificate != "" {
+		block, _ := pem.Decode([]byte(params.Certificate))
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("Certificate must be PEM encoded"), http.StatusBadRequest
+		}
+
+		x509Cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse certificate: %v", err), http.StatusBadRequest
+		}
+
+		if x509Cert.NotAfter.Before(time.Now()) {
+			return nil, fmt.Errorf("Certificate has expired at %v", x509Cert.NotAfter), http.StatusBadRequest
+		}
+
+		fingerprint := certFingerprint(x509Cert)
+		cert.Fingerprint = &fingerprint
+		cert.Subject = x509Cert.Subject.String()
+		cert.NotAfter = &x509Cert.NotAfter
+	} else if params.Fingerprint != "" {
+		fingerprint := strings.ToLower(strings.ReplaceAll(params.Fingerprint, ":", ""))
+		if !fingerprintRe.MatchString(fingerprint) {
+			return nil, fmt.Errorf("Fingerprint must be hex encoded SHA-256 of certificate"), http.StatusBadRequest
+		}
+		cert.Fingerprint = &fingerprint
+	} else if !userInfo.Admin {
+		// subject alone is not proof of owning the certificate, any holder of certificate
+		// issued by trusted CA with the subject would act as this user
+		return nil, fmt.Errorf("Certificate or its fingerprint is required, only superusers can register certificates by subject"), http.StatusForbidden
+	} else if params.Subject == "" {
+		return nil, fmt.Errorf("Either certificate, fingerprint or subject is required"), http.StatusBadRequest
+	}
+
+	err = mh.crutchDB.saveClientCert(ctx, userInfo, cert)
+	if err != nil {
+		return nil, err, http.StatusInternalServerError
+	}
+
+	log.Info("User ", userInfo.Id, " registered client certificate ", cert.Subject)
+
+	return cert, nil, http.StatusCreated
+}
+
+func (mh *MethodHandlers) getClientCertsHandler(w http.ResponseWriter, r *http.Request) error {
+
+	userInfo := mh.getUserInfo(r)
+
+	certs, err := mh.crutchDB.getClientCerts(r.Context(), userInfo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(struct {
+		Certificates []ApiClientCert `json:"certificates"`
+	}{certs})
+
+	if err != nil {
+		err = fmt.Errorf("Error while preparing json reponse: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	return nil
+}
+
+func (mh *MethodHandlers) registerClientCertHandler(w http.ResponseWriter, r *http.Request) error {
+
+	userInfo := mh.getUserInfo(r)
+
+	params := apiClientCertParams{}
+
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		err = fmt.Errorf("Failed to decode request body - %s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+
+	cert, err, code := mh.registerClientCert(r.Context(), userInfo, params)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	err = json.NewEncoder(w).Encode(cert)
+
+	if err != nil {
+		err = fmt.Errorf("Error while preparing json reponse: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	return nil
+}
+
+func (mh *MethodHandlers) revokeClientCertHandler(w http.ResponseWriter, r *http.Request) error {
+
+	userInfo := mh.getUserInfo(r)
+
+	certId, err := strconv.Atoi(mux.Vars(r)["certId"])
+	if err != nil {
+		err = fmt.Errorf("Failed to determine certificate ID: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+
+	err = mh.crutchDB.revokeClientCert(r.Context(), userInfo, certId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return err
+	}
+
+	mh.userCache.invalidateUser(userInfo.Id)
+
+	log.Info("User ", userInfo.Id, " revoked client certificate ", certId)
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
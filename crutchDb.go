@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	crypto_rand "crypto/rand"
 	"errors"
 	"fmt"
+	"math/big"
 	"math/rand"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gosimple/slug"
 	"github.com/jackc/pgconn"
@@ -15,17 +18,200 @@ import (
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/log/logrusadapter"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type CrutchDBHelper struct {
 	pool *pgxpool.Pool
 }
 
+// Password is only filled in when the secret has just been generated,
+// database keeps bcrypt hash of it
 type ApiCredentials struct {
-	Enabled  bool   `json:"enabled"`
-	Login    string `json:"login"`
-	Password string `json:"password"`
-	AuthType string `json:"authType"`
+	Enabled       bool   `json:"enabled"`
+	Login         string `json:"login"`
+	Password      string `json:"password,omitempty"`
+	SigningSecret string `json:"signingSecret,omitempty"`
+	AuthType      string `json:"authType"`
+	// CIDRs API login may be used from, empty means any address
+	AllowedIPs []string `json:"allowedIps"`
+	PasswordRotation
+}
+
+// after rotation with grace period previous password stays valid until PreviousExpiresAt
+type PasswordRotation struct {
+	LastUsedAt         *time.Time `json:"lastUsedAt"`
+	PreviousExpiresAt  *time.Time `json:"previousExpiresAt,omitempty"`
+	PreviousLastUsedAt *time.Time `json:"previousLastUsedAt,omitempty"`
+}
+
+// statements are applied on every start, so each of them must be idempotent
+var crutchDBSchema = []string{
+	`CREATE TABLE IF NOT EXISTS api_credentials (
+		user_id integer NOT NULL UNIQUE,
+		login varchar(255) NOT NULL UNIQUE,
+		enabled boolean NOT NULL DEFAULT FALSE,
+		password varchar(255),
+		date_created timestamp with time zone NOT NULL,
+		date_updated timestamp with time zone NOT NULL
+	)`,
+	`ALTER TABLE api_credentials ALTER COLUMN password DROP NOT NULL`,
+	`ALTER TABLE api_credentials ADD COLUMN IF NOT EXISTS password_hash varchar(255)`,
+	`ALTER TABLE api_credentials ADD COLUMN IF NOT EXISTS id serial`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS api_credentials_id_idx ON api_credentials (id)`,
+	`ALTER TABLE api_credentials ADD COLUMN IF NOT EXISTS name varchar(64) NOT NULL DEFAULT 'default'`,
+	`ALTER TABLE api_credentials ADD COLUMN IF NOT EXISTS scopes text[]`,
+	`ALTER TABLE api_credentials ADD COLUMN IF NOT EXISTS expires_at timestamp with time zone`,
+	`ALTER TABLE api_credentials ADD COLUMN IF NOT EXISTS date_revoked timestamp with time zone`,
+	`ALTER TABLE api_credentials DROP CONSTRAINT IF EXISTS api_credentials_user_id_key`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS api_credentials_user_id_name_idx ON api_credentials (user_id, name) WHERE date_revoked IS NULL`,
+	`CREATE TABLE IF NOT EXISTS api_refresh_tokens (
+		token_hash varchar(64) PRIMARY KEY,
+		user_id integer NOT NULL,
+		api_login varchar(255) NOT NULL,
+		expires_at timestamp with time zone NOT NULL,
+		date_created timestamp with time zone NOT NULL,
+		date_used timestamp with time zone
+	)`,
+	`CREATE TABLE IF NOT EXISTS auth_failures (
+		kind varchar(16) NOT NULL,
+		key varchar(255) NOT NULL,
+		failures integer NOT NULL,
+		last_failure timestamp with time zone NOT NULL,
+		locked_until timestamp with time zone,
+		PRIMARY KEY (kind, key)
+	)`,
+	`CREATE TABLE IF NOT EXISTS auth_lockouts (
+		id serial PRIMARY KEY,
+		login varchar(255) NOT NULL,
+		user_id integer,
+		ip varchar(64) NOT NULL,
+		failures integer NOT NULL,
+		locked_until timestamp with time zone NOT NULL,
+		date_created timestamp with time zone NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS auth_lockouts_user_id_idx ON auth_lockouts (user_id)`,
+	`CREATE TABLE IF NOT EXISTS api_usage (
+		limit_key varchar(255) NOT NULL,
+		company varchar(64) NOT NULL,
+		period varchar(8) NOT NULL,
+		period_start date NOT NULL,
+		requests bigint NOT NULL,
+		PRIMARY KEY (limit_key, period, period_start)
+	)`,
+	`CREATE INDEX IF NOT EXISTS api_usage_company_idx ON api_usage (company, period_start)`,
+	`CREATE TABLE IF NOT EXISTS api_audit_log (
+		id bigserial PRIMARY KEY,
+		date_created timestamp with time zone NOT NULL,
+		user_id integer NOT NULL,
+		contractor_id integer NOT NULL,
+		supplier_id integer NOT NULL,
+		auth_method varchar(16) NOT NULL,
+		api_login varchar(255) NOT NULL,
+		ip varchar(64) NOT NULL,
+		method varchar(8) NOT NULL,
+		endpoint varchar(255) NOT NULL,
+		params jsonb,
+		status integer NOT NULL,
+		response_size integer NOT NULL,
+		duration_ms integer NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS api_audit_log_date_created_idx ON api_audit_log (date_created)`,
+	`CREATE INDEX IF NOT EXISTS api_audit_log_user_id_idx ON api_audit_log (user_id, date_created)`,
+	`CREATE INDEX IF NOT EXISTS api_audit_log_supplier_id_idx ON api_audit_log (supplier_id, date_created)`,
+	`CREATE INDEX IF NOT EXISTS api_audit_log_contractor_id_idx ON api_audit_log (contractor_id, date_created)`,
+	`ALTER TABLE api_audit_log ADD COLUMN IF NOT EXISTS impersonated_by integer`,
+	`CREATE TABLE IF NOT EXISTS api_client_certs (
+		id serial PRIMARY KEY,
+		user_id integer NOT NULL,
+		fingerprint char(64),
+		subject text NOT NULL,
+		scopes text[],
+		not_after timestamp with time zone,
+		date_created timestamp with time zone NOT NULL,
+		date_revoked timestamp with time zone
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS api_client_certs_fingerprint_idx ON api_client_certs (fingerprint) WHERE date_revoked IS NULL`,
+	`DROP INDEX IF EXISTS api_client_certs_subject_idx`,
+	// certificate registered by subject only maps every certificate with the subject, so the subject
+	// must belong to one user; later duplicates registered before the index existed are revoked
+	`UPDATE api_client_certs c SET date_revoked = NOW()
+		WHERE c.fingerprint IS NULL AND c.date_revoked IS NULL AND EXISTS (
+			SELECT 1 FROM api_client_certs o
+			WHERE o.fingerprint IS NULL AND o.date_revoked IS NULL AND o.subject = c.subject AND o.id < c.id)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS api_client_certs_active_subject_idx ON api_client_certs (subject) WHERE date_revoked IS NULL AND fingerprint IS NULL`,
+	`ALTER TABLE api_credentials ADD COLUMN IF NOT EXISTS signing_secret bytea`,
+	`CREATE TABLE IF NOT EXISTS api_nonces (
+		api_login varchar(255) NOT NULL,
+		nonce varchar(64) NOT NULL,
+		date_created timestamp with time zone NOT NULL,
+		PRIMARY KEY (api_login, nonce)
+	)`,
+	`ALTER TABLE api_credentials ALTER COLUMN user_id DROP NOT NULL`,
+	`ALTER TABLE api_credentials ADD COLUMN IF NOT EXISTS contractor_id integer`,
+	`ALTER TABLE api_credentials ADD COLUMN IF NOT EXISTS supplier_id integer`,
+	`ALTER TABLE api_credentials ADD COLUMN IF NOT EXISTS created_by integer`,
+	`ALTER TABLE api_credentials ADD COLUMN IF NOT EXISTS last_used_at timestamp with time zone`,
+	`ALTER TABLE api_credentials ADD COLUMN IF NOT EXISTS previous_password_hash varchar(255)`,
+	`ALTER TABLE api_credentials ADD COLUMN IF NOT EXISTS previous_expires_at timestamp with time zone`,
+	`ALTER TABLE api_credentials ADD COLUMN IF NOT EXISTS previous_last_used_at timestamp with time zone`,
+	`ALTER TABLE api_credentials ADD COLUMN IF NOT EXISTS allowed_ips text[]`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS api_credentials_service_account_name_idx ON api_credentials (COALESCE(contractor_id, 0), COALESCE(supplier_id, 0), name) WHERE user_id IS NULL AND date_revoked IS NULL`,
+}
+
+// credentials created via GET /apiCredentials, they are not limited by scopes
+const defaultApiKeyName = "default"
+
+// named API key, user might have several of them (one for ERP, another one for BI and so on)
+type ApiKey struct {
+	Id          int        `json:"id"`
+	Name        string     `json:"name"`
+	Login       string     `json:"login"`
+	Password    string     `json:"password,omitempty"`
+	Enabled     bool       `json:"enabled"`
+	Scopes      []string   `json:"scopes"`
+	ExpiresAt   *time.Time `json:"expiresAt"`
+	DateCreated time.Time  `json:"dateCreated"`
+}
+
+// API credentials owned by contractor or supplier company rather than by user (user_id is NULL)
+type ServiceAccount struct {
+	Id           int        `json:"id"`
+	Name         string     `json:"name"`
+	Login        string     `json:"login"`
+	Password     string     `json:"password,omitempty"`
+	Enabled      bool       `json:"enabled"`
+	Scopes       []string   `json:"scopes"`
+	ExpiresAt    *time.Time `json:"expiresAt"`
+	ContractorId int        `json:"contractorId"`
+	SupplierId   int        `json:"supplierId"`
+	CreatedBy    int        `json:"createdBy"`
+	DateCreated  time.Time  `json:"dateCreated"`
+	PasswordRotation
+}
+
+// number of API requests done during the day or month
+type ApiUsage struct {
+	LimitKey    string    `json:"limitKey"`
+	Company     string    `json:"company"`
+	Period      string    `json:"period"`
+	PeriodStart time.Time `json:"periodStart"`
+	Requests    int       `json:"requests"`
+}
+
+// what is stored for API login, used to authenticate requests
+type ApiLoginCreds struct {
+	UserId       int // 0 for service accounts
+	ContractorId int
+	SupplierId   int
+	PasswordHash string
+	// set only while grace period after rotation lasts
+	PreviousPasswordHash *string
+	Scopes               []string
+	SigningSecret        []byte // encrypted
+	AllowedIPs           []string
+	// date_updated changes with every change of credentials, access tokens carry it as version
+	DateUpdated time.Time
 }
 
 func initCrutchDBHelper(host string, user string, password string, database string) (*CrutchDBHelper, error) {
@@ -43,9 +229,85 @@ func initCrutchDBHelper(host string, user string, password string, database stri
 	}
 
 	db := CrutchDBHelper{pool}
+
+	err = db.migrate(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
 	return &db, nil
 }
 
+func (db *CrutchDBHelper) migrate(ctx context.Context) error {
+	for _, stmt := range crutchDBSchema {
+		if _, err := db.pool.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("Failed to update crutch DB schema: %v", err)
+		}
+	}
+
+	return db.hashPlaintextPasswords(ctx)
+}
+
+// credentials created before passwords were hashed still keep them in plain text,
+// replace those with hashes so that existing integrations continue to work
+func (db *CrutchDBHelper) hashPlaintextPasswords(ctx context.Context) error {
+	rows, _ := db.pool.Query(ctx, "SELECT id, password FROM api_credentials WHERE password_hash IS NULL AND password IS NOT NULL")
+	defer rows.Close()
+
+	passwords := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var password string
+		err := rows.Scan(&id, &password)
+		if err != nil {
+			return err
+		}
+		passwords[id] = password
+	}
+	if rows.Err() != nil {
+		return fmt.Errorf("Failed to retrieve plain text API passwords: %v", rows.Err())
+	}
+
+	for id, password := range passwords {
+		hash, err := hashApiPassword(password)
+		if err != nil {
+			return err
+		}
+
+		_, err = db.pool.Exec(ctx, "UPDATE api_credentials SET password_hash=$1, password=NULL WHERE id=$2", hash, id)
+		if err != nil {
+			return fmt.Errorf("Failed to hash API password %v: %v", id, err)
+		}
+	}
+
+	if len(passwords) > 0 {
+		log.Info("Hashed ", len(passwords), " plain text API passwords")
+	}
+
+	return nil
+}
+
+func hashApiPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("Failed to hash password: %v", err)
+	}
+	return string(hash), nil
+}
+
+func checkApiPassword(hash string, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// random index that does not depend on math/rand seed
+func randomIndex(n int) int {
+	i, err := crypto_rand.Int(crypto_rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic(err)
+	}
+	return int(i.Int64())
+}
+
 func generatePassword(passwordLength, minSpecialChar, minNum, minUpperCase int) string {
 	var (
 		lowerCharSet   = "abcdedfghijklmnopqrst"
@@ -59,31 +321,32 @@ func generatePassword(passwordLength, minSpecialChar, minNum, minUpperCase int)
 
 	//Set special character
 	for i := 0; i < minSpecialChar; i++ {
-		random := rand.Intn(len(specialCharSet))
+		random := randomIndex(len(specialCharSet))
 		password.WriteString(string(specialCharSet[random]))
 	}
 
 	//Set numeric
 	for i := 0; i < minNum; i++ {
-		random := rand.Intn(len(numberSet))
+		random := randomIndex(len(numberSet))
 		password.WriteString(string(numberSet[random]))
 	}
 
 	//Set uppercase
 	for i := 0; i < minUpperCase; i++ {
-		random := rand.Intn(len(upperCharSet))
+		random := randomIndex(len(upperCharSet))
 		password.WriteString(string(upperCharSet[random]))
 	}
 
 	remainingLength := passwordLength - minSpecialChar - minNum - minUpperCase
 	for i := 0; i < remainingLength; i++ {
-		random := rand.Intn(len(allCharSet))
+		random := randomIndex(len(allCharSet))
 		password.WriteString(string(allCharSet[random]))
 	}
 	inRune := []rune(password.String())
-	rand.Shuffle(len(inRune), func(i, j int) {
+	for i := len(inRune) - 1; i > 0; i-- {
+		j := randomIndex(i + 1)
 		inRune[i], inRune[j] = inRune[j], inRune[i]
-	})
+	}
 	return string(inRune)
 }
 
@@ -97,21 +360,40 @@ func genApiLogin(userInfo UserInfo) string {
 func (db *CrutchDBHelper) getApiCredentials(ctx context.Context, userInfo UserInfo) (*ApiCredentials, error) {
 	api := ApiCredentials{AuthType: "Basic"}
 
+	// bcrypt is slow, so password is generated only when there are no credentials yet
+	err := db.pool.QueryRow(ctx, `
+		SELECT login, enabled, allowed_ips, last_used_at, previous_expires_at, previous_last_used_at 
+		FROM api_credentials WHERE user_id=$1 AND name=$2 AND date_revoked IS NULL`,
+		userInfo.Id, defaultApiKeyName).Scan(&api.Login, &api.Enabled, &api.AllowedIPs, &api.LastUsedAt, &api.PreviousExpiresAt, &api.PreviousLastUsedAt)
+	if err == nil {
+		return &api, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("Failed to retrieve user API credentials: %v", err)
+	}
+
 	login := genApiLogin(userInfo)
 	suffix := ""
 
+	password := generatePassword(16, 2, 2, 2)
+	passwordHash, err := hashApiPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
 	for {
+		var created bool
 		err := db.pool.QueryRow(ctx, `
 			WITH e AS(
-				INSERT INTO api_credentials (user_id, login, enabled, password, date_created, date_updated) 
-						 VALUES ($1, $2, False, $3, NOW(), NOW())
-				ON CONFLICT(user_id) DO NOTHING
+				INSERT INTO api_credentials (user_id, name, login, enabled, password_hash, date_created, date_updated) 
+						 VALUES ($1, $4, $2, False, $3, NOW(), NOW())
+				ON CONFLICT(user_id, name) WHERE date_revoked IS NULL DO NOTHING
 				RETURNING *
 			)
-			SELECT login, enabled, password FROM e
+			SELECT login, enabled, allowed_ips, last_used_at, previous_expires_at, previous_last_used_at, TRUE FROM e
 			UNION
-			SELECT login, enabled, password FROM api_credentials WHERE user_id=$1
-			`, userInfo.Id, login+suffix, generatePassword(16, 2, 2, 2)).Scan(&api.Login, &api.Enabled, &api.Password)
+			SELECT login, enabled, allowed_ips, last_used_at, previous_expires_at, previous_last_used_at, FALSE FROM api_credentials WHERE user_id=$1 AND name=$4 AND date_revoked IS NULL
+			`, userInfo.Id, login+suffix, passwordHash, defaultApiKeyName).Scan(&api.Login, &api.Enabled, &api.AllowedIPs, &api.LastUsedAt, &api.PreviousExpiresAt, &api.PreviousLastUsedAt, &created)
 
 		if err != nil {
 			var pgErr *pgconn.PgError
@@ -121,6 +403,11 @@ func (db *CrutchDBHelper) getApiCredentials(ctx context.Context, userInfo UserIn
 			}
 			return nil, fmt.Errorf("Failed to retrieve user API credentials: %v", err)
 		}
+
+		// password is shown only once, right after it was generated
+		if created {
+			api.Password = password
+		}
 		break
 	}
 
@@ -128,26 +415,652 @@ func (db *CrutchDBHelper) getApiCredentials(ctx context.Context, userInfo UserIn
 
 }
 
-func (db *CrutchDBHelper) setApiCredentialsEnabled(ctx context.Context, userInfo UserInfo, enabled bool) (*ApiCredentials, error) {
+func (db *CrutchDBHelper) setApiCredentialsAllowedIPs(ctx context.Context, userInfo UserInfo, allowedIPs []string) (*ApiCredentials, error) {
 
 	api := ApiCredentials{AuthType: "Basic"}
-	err := db.pool.QueryRow(ctx, "UPDATE api_credentials SET enabled=$1, date_updated=NOW() WHERE user_id=$2 RETURNING login, enabled, password", enabled, userInfo.Id).Scan(&api.Login, &api.Enabled, &api.Password)
+	err := db.pool.QueryRow(ctx, "UPDATE api_credentials SET allowed_ips=$1, date_updated=NOW() WHERE user_id=$2 AND name=$3 AND date_revoked IS NULL RETURNING login, enabled, allowed_ips", allowedIPs, userInfo.Id, defaultApiKeyName).Scan(&api.Login, &api.Enabled, &api.AllowedIPs)
 
 	return &api, err
 }
 
-func (db *CrutchDBHelper) updateApiCredentialsPassword(ctx context.Context, userInfo UserInfo) (*ApiCredentials, error) {
+func (db *CrutchDBHelper) setApiCredentialsEnabled(ctx context.Context, userInfo UserInfo, enabled bool) (*ApiCredentials, error) {
 
 	api := ApiCredentials{AuthType: "Basic"}
-	err := db.pool.QueryRow(ctx, "UPDATE api_credentials SET password=$1, date_updated=NOW() WHERE user_id=$2 RETURNING login, enabled, password", generatePassword(16, 2, 2, 2), userInfo.Id).Scan(&api.Login, &api.Enabled, &api.Password)
+	err := db.pool.QueryRow(ctx, "UPDATE api_credentials SET enabled=$1, date_updated=NOW() WHERE user_id=$2 AND name=$3 AND date_revoked IS NULL RETURNING login, enabled, allowed_ips", enabled, userInfo.Id, defaultApiKeyName).Scan(&api.Login, &api.Enabled, &api.AllowedIPs)
 
 	return &api, err
 }
 
-func (db *CrutchDBHelper) getUserCredsFromApiLogin(ctx context.Context, login string) (int, string, error) {
-	var password string
-	var user_id int
-	err := db.pool.QueryRow(ctx, "SELECT user_id, password FROM api_credentials WHERE login=$1 AND enabled=true", login).Scan(&user_id, &password)
+// with positive grace period current password stays valid for that time as previous one
+func (db *CrutchDBHelper) updateApiCredentialsPassword(ctx context.Context, userInfo UserInfo, gracePeriod time.Duration) (*ApiCredentials, error) {
+
+	password := generatePassword(16, 2, 2, 2)
+	passwordHash, err := hashApiPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	api := ApiCredentials{AuthType: "Basic", Password: password}
+	err = db.pool.QueryRow(ctx, `
+		UPDATE api_credentials SET password_hash=$1, password=NULL, date_updated=NOW(), `+keepPreviousPassword("$4")+` 
+		WHERE user_id=$2 AND name=$3 AND date_revoked IS NULL 
+		RETURNING login, enabled, allowed_ips, last_used_at, previous_expires_at, previous_last_used_at`,
+		passwordHash, userInfo.Id, defaultApiKeyName, int(gracePeriod.Seconds())).Scan(&api.Login, &api.Enabled, &api.AllowedIPs, &api.LastUsedAt, &api.PreviousExpiresAt, &api.PreviousLastUsedAt)
+
+	return &api, err
+}
+
+// SET clause keeping replaced password valid for grace period, given in seconds by graceArg placeholder;
+// expressions on the right side see values the row had before update
+func keepPreviousPassword(graceArg string) string {
+	return `
+			previous_password_hash = CASE WHEN ` + graceArg + ` > 0 THEN password_hash END, 
+			previous_expires_at = CASE WHEN ` + graceArg + ` > 0 THEN NOW() + ` + graceArg + ` * interval '1 second' END, 
+			previous_last_used_at = NULL, 
+			last_used_at = NULL`
+}
+
+// records which of passwords was used, updated at most once a minute to spare DB
+func (db *CrutchDBHelper) markApiPasswordUsed(ctx context.Context, login string, previous bool) error {
+	column := "last_used_at"
+	if previous {
+		column = "previous_last_used_at"
+	}
+
+	_, err := db.pool.Exec(ctx, `
+		UPDATE api_credentials SET `+column+`=NOW() 
+		WHERE login=$1 AND date_revoked IS NULL AND (`+column+` IS NULL OR `+column+` < NOW() - interval '1 minute')`, login)
+	if err != nil {
+		return fmt.Errorf("Failed to record API password usage: %v", err)
+	}
+	return nil
+}
+
+func (db *CrutchDBHelper) getUserCredsFromApiLogin(ctx context.Context, login string) (*ApiLoginCreds, error) {
+	creds := ApiLoginCreds{}
+	err := db.pool.QueryRow(ctx, `
+		SELECT COALESCE(user_id, 0), COALESCE(contractor_id, 0), COALESCE(supplier_id, 0), password_hash, 
+			CASE WHEN previous_expires_at > NOW() THEN previous_password_hash END, scopes, signing_secret, allowed_ips, date_updated 
+		FROM api_credentials 
+		WHERE login=$1 
+			AND enabled=true 
+			AND password_hash IS NOT NULL 
+			AND date_revoked IS NULL 
+			AND (expires_at IS NULL OR expires_at > NOW())`, login).Scan(&creds.UserId, &creds.ContractorId, &creds.SupplierId, &creds.PasswordHash, &creds.PreviousPasswordHash, &creds.Scopes, &creds.SigningSecret, &creds.AllowedIPs, &creds.DateUpdated)
+	if err != nil {
+		return nil, err
+	}
+
+	return &creds, nil
+}
+
+// no rows when credentials are revoked, disabled or expired
+func (db *CrutchDBHelper) getApiCredentialsVersion(ctx context.Context, login string) (int64, error) {
+	var dateUpdated time.Time
+	err := db.pool.QueryRow(ctx, `
+		SELECT date_updated 
+		FROM api_credentials 
+		WHERE login=$1 
+			AND enabled=true 
+			AND password_hash IS NOT NULL 
+			AND date_revoked IS NULL 
+			AND (expires_at IS NULL OR expires_at > NOW())`, login).Scan(&dateUpdated)
+	if err != nil {
+		return 0, err
+	}
+
+	return dateUpdated.UnixNano(), nil
+}
+
+func (db *CrutchDBHelper) getApiKeys(ctx context.Context, userInfo UserInfo) ([]ApiKey, error) {
+	rows, _ := db.pool.Query(ctx, `
+		SELECT id, name, login, enabled, scopes, expires_at, date_created 
+		FROM api_credentials 
+		WHERE user_id=$1 AND date_revoked IS NULL 
+		ORDER BY date_created`, userInfo.Id)
+
+	keys := make([]ApiKey, 0)
+	for rows.Next() {
+		var key ApiKey
+		err := rows.Scan(&key.Id, &key.Name, &key.Login, &key.Enabled, &key.Scopes, &key.ExpiresAt, &key.DateCreated)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("Failed to retrieve user API keys: %v", rows.Err())
+	}
+
+	return keys, nil
+}
+
+func (db *CrutchDBHelper) createApiKey(ctx context.Context, userInfo UserInfo, name string, scopes []string, expiresAt *time.Time) (*ApiKey, error) {
+
+	login := genApiLogin(userInfo) + "-" + slug.Make(name)
+	suffix := ""
+
+	password := generatePassword(16, 2, 2, 2)
+	passwordHash, err := hashApiPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	key := ApiKey{Name: name, Password: password, Scopes: scopes, ExpiresAt: expiresAt}
+	for {
+		err := db.pool.QueryRow(ctx, `
+			INSERT INTO api_credentials (user_id, name, login, enabled, password_hash, scopes, expires_at, date_created, date_updated) 
+				VALUES ($1, $2, $3, TRUE, $4, $5, $6, NOW(), NOW())
+			RETURNING id, login, enabled, date_created`,
+			userInfo.Id, name, login+suffix, passwordHash, scopes, expiresAt).Scan(&key.Id, &key.Login, &key.Enabled, &key.DateCreated)
+
+		if err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+				if pgErr.ConstraintName == "api_credentials_user_id_name_idx" {
+					return nil, fmt.Errorf("API key named '%s' already exists", name)
+				}
+				suffix = strconv.Itoa(rand.Intn(100))
+				continue
+			}
+			return nil, fmt.Errorf("Failed to create API key: %v", err)
+		}
+		break
+	}
+
+	return &key, nil
+}
+
+func (db *CrutchDBHelper) revokeApiKey(ctx context.Context, userInfo UserInfo, keyId int) error {
+	res, err := db.pool.Exec(ctx, "UPDATE api_credentials SET date_revoked=NOW(), enabled=FALSE, date_updated=NOW() WHERE id=$1 AND user_id=$2 AND date_revoked IS NULL", keyId, userInfo.Id)
+	if err != nil {
+		return fmt.Errorf("Failed to revoke API key: %v", err)
+	}
+
+	if res.RowsAffected() == 0 {
+		return fmt.Errorf("API key %v does not exist", keyId)
+	}
+
+	return nil
+}
+
+func (db *CrutchDBHelper) saveRefreshToken(ctx context.Context, tokenHash string, userId int, login string, expiresAt time.Time) error {
+	_, err := db.pool.Exec(ctx, "DELETE FROM api_refresh_tokens WHERE api_login=$1 AND (expires_at < NOW() OR date_used IS NOT NULL)", login)
+	if err != nil {
+		return fmt.Errorf("Failed to clean up refresh tokens: %v", err)
+	}
+
+	_, err = db.pool.Exec(ctx, "INSERT INTO api_refresh_tokens (token_hash, user_id, api_login, expires_at, date_created) VALUES ($1, $2, $3, $4, NOW())", tokenHash, userId, login, expiresAt)
+	if err != nil {
+		return fmt.Errorf("Failed to save refresh token: %v", err)
+	}
+
+	return nil
+}
+
+func (db *CrutchDBHelper) consumeRefreshToken(ctx context.Context, tokenHash string) (userId int, login string, err error) {
+	err = db.pool.QueryRow(ctx, `
+		UPDATE api_refresh_tokens SET date_used=NOW() 
+		WHERE token_hash=$1 AND date_used IS NULL AND expires_at > NOW() 
+		RETURNING user_id, api_login`, tokenHash).Scan(&userId, &login)
+
+	return userId, login, err
+}
+
+// the latest lock of API login or client IP, nil if none of them is locked,
+// and failures counted for API login, so that successful login resets only existing counter
+func (db *CrutchDBHelper) getAuthLock(ctx context.Context, login string, ip string) (lockedUntil *time.Time, failures int, err error) {
+	err = db.pool.QueryRow(ctx, `
+		SELECT MAX(locked_until) FILTER (WHERE locked_until > NOW()), COALESCE(MAX(failures) FILTER (WHERE kind=$1), 0) 
+		FROM auth_failures 
+		WHERE (kind=$1 AND key=$2) OR (kind=$3 AND key=$4)`,
+		authFailureKindLogin, login, authFailureKindIP, ip).Scan(&lockedUntil, &failures)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to check auth lock: %v", err)
+	}
+
+	return lockedUntil, failures, nil
+}
+
+// failures counter starts from scratch when there were no failures for lockoutMax
+func (db *CrutchDBHelper) registerAuthFailure(ctx context.Context, kind string, key string) (failures int, err error) {
+	err = db.pool.QueryRow(ctx, `
+		INSERT INTO auth_failures (kind, key, failures, last_failure) VALUES ($1, $2, 1, NOW())
+		ON CONFLICT (kind, key) DO UPDATE SET 
+			failures = CASE WHEN auth_failures.last_failure < NOW() - $3 * interval '1 second' THEN 1 ELSE auth_failures.failures + 1 END,
+			last_failure = NOW()
+		RETURNING failures`, kind, key, int(lockoutMax.Seconds())).Scan(&failures)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to register auth failure: %v", err)
+	}
+
+	return failures, nil
+}
+
+func (db *CrutchDBHelper) setAuthLock(ctx context.Context, kind string, key string, lockedUntil time.Time) error {
+	_, err := db.pool.Exec(ctx, "UPDATE auth_failures SET locked_until=$3 WHERE kind=$1 AND key=$2", kind, key, lockedUntil)
+	if err != nil {
+		return fmt.Errorf("Failed to lock %s %s: %v", kind, key, err)
+	}
+	return nil
+}
+
+func (db *CrutchDBHelper) resetAuthFailures(ctx context.Context, kind string, key string) error {
+	_, err := db.pool.Exec(ctx, "DELETE FROM auth_failures WHERE kind=$1 AND key=$2", kind, key)
+	if err != nil {
+		return fmt.Errorf("Failed to reset auth failures: %v", err)
+	}
+	return nil
+}
+
+func (db *CrutchDBHelper) saveAuthLockout(ctx context.Context, login string, userId *int, ip string, failures int, lockedUntil time.Time) error {
+	_, err := db.pool.Exec(ctx, `
+		INSERT INTO auth_lockouts (login, user_id, ip, failures, locked_until, date_created) 
+		VALUES ($1, $2, $3, $4, $5, NOW())`, login, userId, ip, failures, lockedUntil)
+	if err != nil {
+		return fmt.Errorf("Failed to save lockout event: %v", err)
+	}
+	return nil
+}
+
+// lockouts of given users and of service accounts of the company, all lockouts (including unknown logins) if userIds is nil
+func (db *CrutchDBHelper) getAuthLockouts(ctx context.Context, userIds []int, contractorId int, supplierId int) ([]AuthLockout, error) {
+	query := "SELECT id, login, user_id, ip, failures, locked_until, date_created FROM auth_lockouts"
+	args := make([]interface{}, 0)
+	if userIds != nil {
+		args = append(args, userIds, contractorId, supplierId)
+		// revoked service accounts are included, their lockouts are still history of the company
+		query += ` WHERE user_id = ANY($1) OR (user_id IS NULL AND login IN (
+			SELECT login FROM api_credentials WHERE user_id IS NULL AND COALESCE(contractor_id, 0)=$2 AND COALESCE(supplier_id, 0)=$3))`
+	}
+	query += " ORDER BY date_created DESC LIMIT 1000"
+
+	rows, _ := db.pool.Query(ctx, query, args...)
+
+	lockouts := make([]AuthLockout, 0)
+	for rows.Next() {
+		var l AuthLockout
+		err := rows.Scan(&l.Id, &l.Login, &l.UserId, &l.IP, &l.Failures, &l.LockedUntil, &l.DateCreated)
+		if err != nil {
+			return nil, err
+		}
+		lockouts = append(lockouts, l)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("Failed to retrieve lockout events: %v", rows.Err())
+	}
+
+	return lockouts, nil
+}
+
+// increments daily and monthly counters, returns their new values
+// adds requests to counters of the day and of its month, returns their new values
+func (db *CrutchDBHelper) addApiRequests(ctx context.Context, limitKey string, company string, day time.Time, requests int) (daily int, monthly int, err error) {
+	rows, _ := db.pool.Query(ctx, `
+		INSERT INTO api_usage (limit_key, company, period, period_start, requests) 
+		VALUES 
+			($1, $2, 'day', $3::date, $4), 
+			($1, $2, 'month', date_trunc('month', $3::date)::date, $4)
+		ON CONFLICT (limit_key, period, period_start) DO UPDATE SET requests = api_usage.requests + $4
+		RETURNING period, requests`, limitKey, company, day, requests)
+	defer rows.Close()
+
+	return scanApiRequests(rows)
+}
+
+func (db *CrutchDBHelper) getApiRequests(ctx context.Context, limitKey string, day time.Time) (daily int, monthly int, err error) {
+	rows, _ := db.pool.Query(ctx, `
+		SELECT period, requests FROM api_usage 
+		WHERE limit_key = $1 AND (
+			(period = 'day' AND period_start = $2::date) OR 
+			(period = 'month' AND period_start = date_trunc('month', $2::date)::date))`, limitKey, day)
+	defer rows.Close()
+
+	return scanApiRequests(rows)
+}
+
+func scanApiRequests(rows pgx.Rows) (daily int, monthly int, err error) {
+	for rows.Next() {
+		var period string
+		var requests int
+		err = rows.Scan(&period, &requests)
+		if err != nil {
+			return 0, 0, err
+		}
+		if period == "day" {
+			daily = requests
+		} else {
+			monthly = requests
+		}
+	}
+
+	if rows.Err() != nil {
+		return 0, 0, fmt.Errorf("Failed to retrieve API request counters: %v", rows.Err())
+	}
+
+	return daily, monthly, nil
+}
+
+// API usage of the company, usage of all companies if company is empty
+func (db *CrutchDBHelper) getApiUsage(ctx context.Context, company string, start time.Time, end time.Time) ([]ApiUsage, error) {
+	query := "SELECT limit_key, company, period, period_start, requests FROM api_usage WHERE period_start >= date_trunc('month', $1::date) AND period_start <= $2"
+	args := []interface{}{start, end}
+	if company != "" {
+		args = append(args, company)
+		query += " AND company = $" + strconv.Itoa(len(args))
+	}
+	query += " ORDER BY period_start DESC, period, limit_key"
+
+	rows, _ := db.pool.Query(ctx, query, args...)
+
+	usage := make([]ApiUsage, 0)
+	for rows.Next() {
+		var u ApiUsage
+		err := rows.Scan(&u.LimitKey, &u.Company, &u.Period, &u.PeriodStart, &u.Requests)
+		if err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("Failed to retrieve API usage: %v", rows.Err())
+	}
+
+	return usage, nil
+}
+
+func (db *CrutchDBHelper) saveAuditEntry(ctx context.Context, e AuditEntry) error {
+	_, err := db.pool.Exec(ctx, `
+		INSERT INTO api_audit_log (date_created, user_id, contractor_id, supplier_id, auth_method, api_login, ip, method, endpoint, params, status, response_size, duration_ms, impersonated_by) 
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+		e.DateCreated, e.UserId, e.ContractorId, e.SupplierId, e.AuthMethod, e.ApiLogin, e.IP, e.Method, e.Endpoint, e.Params, e.Status, e.ResponseSize, e.DurationMs, e.ImpersonatedBy)
+	if err != nil {
+		return fmt.Errorf("Failed to save audit entry: %v", err)
+	}
+	return nil
+}
+
+func (db *CrutchDBHelper) deleteAuditEntriesBefore(ctx context.Context, before time.Time) (int64, error) {
+	res, err := db.pool.Exec(ctx, "DELETE FROM api_audit_log WHERE date_created < $1", before)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to remove old audit entries: %v", err)
+	}
+	return res.RowsAffected(), nil
+}
+
+func (db *CrutchDBHelper) getAuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	query := `
+		SELECT id, date_created, user_id, contractor_id, supplier_id, auth_method, api_login, ip, method, endpoint, params, status, response_size, duration_ms, impersonated_by 
+		FROM api_audit_log 
+		WHERE TRUE`
+	args := make([]interface{}, 0)
+
+	if !filter.Start.IsZero() {
+		args = append(args, filter.Start)
+		query += " AND date_created >= $" + strconv.Itoa(len(args))
+	}
+	if !filter.End.IsZero() {
+		args = append(args, filter.End)
+		query += " AND date_created <= $" + strconv.Itoa(len(args))
+	}
+	if filter.UserId > 0 {
+		args = append(args, filter.UserId)
+		query += " AND user_id = $" + strconv.Itoa(len(args))
+	}
+	if filter.ContractorId > 0 {
+		args = append(args, filter.ContractorId)
+		query += " AND contractor_id = $" + strconv.Itoa(len(args))
+	}
+	if filter.SupplierId > 0 {
+		args = append(args, filter.SupplierId)
+		query += " AND supplier_id = $" + strconv.Itoa(len(args))
+	}
+	if filter.ApiLogin != "" {
+		args = append(args, filter.ApiLogin)
+		query += " AND api_login = $" + strconv.Itoa(len(args))
+	}
+
+	args = append(args, filter.ItemsPerPage)
+	query += " ORDER BY date_created DESC LIMIT $" + strconv.Itoa(len(args))
+	args = append(args, filter.ItemsPerPage*filter.Page)
+	query += " OFFSET $" + strconv.Itoa(len(args))
+
+	rows, _ := db.pool.Query(ctx, query, args...)
+
+	entries := make([]AuditEntry, 0)
+	for rows.Next() {
+		var e AuditEntry
+		err := rows.Scan(&e.Id, &e.DateCreated, &e.UserId, &e.ContractorId, &e.SupplierId, &e.AuthMethod, &e.ApiLogin, &e.IP, &e.Method, &e.Endpoint, &e.Params, &e.Status, &e.ResponseSize, &e.DurationMs, &e.ImpersonatedBy)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("Failed to retrieve audit entries: %v", rows.Err())
+	}
+
+	return entries, nil
+}
+
+// certificate registered by fingerprint takes precedence over one registered by subject
+func (db *CrutchDBHelper) getUserCredsFromClientCert(ctx context.Context, fingerprint string, subject string) (*ApiLoginCreds, error) {
+	creds := ApiLoginCreds{}
+	err := db.pool.QueryRow(ctx, `
+		SELECT user_id, scopes 
+		FROM api_client_certs 
+		WHERE (fingerprint=$1 OR (fingerprint IS NULL AND subject=$2)) 
+			AND date_revoked IS NULL AND (not_after IS NULL OR not_after > NOW()) 
+		ORDER BY fingerprint NULLS LAST 
+		LIMIT 1`, fingerprint, subject).Scan(&creds.UserId, &creds.Scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &creds, nil
+}
+
+func (db *CrutchDBHelper) getClientCerts(ctx context.Context, userInfo UserInfo) ([]ApiClientCert, error) {
+	rows, _ := db.pool.Query(ctx, `
+		SELECT id, fingerprint, subject, scopes, not_after, date_created 
+		FROM api_client_certs 
+		WHERE user_id=$1 AND date_revoked IS NULL 
+		ORDER BY date_created`, userInfo.Id)
+
+	certs := make([]ApiClientCert, 0)
+	for rows.Next() {
+		var cert ApiClientCert
+		err := rows.Scan(&cert.Id, &cert.Fingerprint, &cert.Subject, &cert.Scopes, &cert.NotAfter, &cert.DateCreated)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("Failed to retrieve client certificates: %v", rows.Err())
+	}
+
+	return certs, nil
+}
+
+func (db *CrutchDBHelper) saveClientCert(ctx context.Context, userInfo UserInfo, cert *ApiClientCert) error {
+	err := db.pool.QueryRow(ctx, `
+		INSERT INTO api_client_certs (user_id, fingerprint, subject, scopes, not_after, date_created) 
+			VALUES ($1, $2, $3, $4, $5, NOW()) 
+		RETURNING id, date_created`,
+		userInfo.Id, cert.Fingerprint, cert.Subject, cert.Scopes, cert.NotAfter).Scan(&cert.Id, &cert.DateCreated)
+
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			return fmt.Errorf("Certificate is already registered")
+		}
+		return fmt.Errorf("Failed to register client certificate: %v", err)
+	}
+
+	return nil
+}
+
+func (db *CrutchDBHelper) revokeClientCert(ctx context.Context, userInfo UserInfo, certId int) error {
+	res, err := db.pool.Exec(ctx, "UPDATE api_client_certs SET date_revoked=NOW() WHERE id=$1 AND user_id=$2 AND date_revoked IS NULL", certId, userInfo.Id)
+	if err != nil {
+		return fmt.Errorf("Failed to revoke client certificate: %v", err)
+	}
+
+	if res.RowsAffected() == 0 {
+		return fmt.Errorf("Client certificate %v does not exist", certId)
+	}
+
+	return nil
+}
+
+// keyId 0 means default API credentials of the user
+func (db *CrutchDBHelper) setApiSigningSecret(ctx context.Context, userInfo UserInfo, keyId int, encryptedSecret []byte) (string, error) {
+	var login string
+	err := db.pool.QueryRow(ctx, `
+		UPDATE api_credentials SET signing_secret=$1, date_updated=NOW() 
+		WHERE user_id=$2 AND ((id=$3) OR ($3=0 AND name=$4)) AND date_revoked IS NULL 
+		RETURNING login`, encryptedSecret, userInfo.Id, keyId, defaultApiKeyName).Scan(&login)
+	if err != nil {
+		return "", fmt.Errorf("API key %v does not exist: %v", keyId, err)
+	}
+
+	return login, nil
+}
+
+// fails if nonce was already used by the API login
+func (db *CrutchDBHelper) saveNonce(ctx context.Context, login string, nonce string) error {
+	_, err := db.pool.Exec(ctx, "INSERT INTO api_nonces (api_login, nonce, date_created) VALUES ($1, $2, NOW())", login, nonce)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			return fmt.Errorf("Nonce %s was already used, request is rejected as replay", nonce)
+		}
+		return fmt.Errorf("Failed to save nonce: %v", err)
+	}
+
+	return nil
+}
+
+func (db *CrutchDBHelper) deleteNoncesBefore(ctx context.Context, before time.Time) error {
+	_, err := db.pool.Exec(ctx, "DELETE FROM api_nonces WHERE date_created < $1", before)
+	if err != nil {
+		return fmt.Errorf("Failed to remove old nonces: %v", err)
+	}
+	return nil
+}
+
+// service accounts of the company user belongs to
+func (db *CrutchDBHelper) getServiceAccounts(ctx context.Context, contractorId int, supplierId int) ([]ServiceAccount, error) {
+	rows, _ := db.pool.Query(ctx, `
+		SELECT id, name, login, enabled, scopes, expires_at, COALESCE(contractor_id, 0), COALESCE(supplier_id, 0), COALESCE(created_by, 0), date_created, last_used_at, previous_expires_at, previous_last_used_at 
+		FROM api_credentials 
+		WHERE user_id IS NULL AND COALESCE(contractor_id, 0)=$1 AND COALESCE(supplier_id, 0)=$2 AND date_revoked IS NULL 
+		ORDER BY date_created`, contractorId, supplierId)
+
+	accounts := make([]ServiceAccount, 0)
+	for rows.Next() {
+		var sa ServiceAccount
+		err := rows.Scan(&sa.Id, &sa.Name, &sa.Login, &sa.Enabled, &sa.Scopes, &sa.ExpiresAt, &sa.ContractorId, &sa.SupplierId, &sa.CreatedBy, &sa.DateCreated, &sa.LastUsedAt, &sa.PreviousExpiresAt, &sa.PreviousLastUsedAt)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, sa)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("Failed to retrieve service accounts: %v", rows.Err())
+	}
+
+	return accounts, nil
+}
+
+func (db *CrutchDBHelper) createServiceAccount(ctx context.Context, sa *ServiceAccount, companyName string) error {
+
+	login := "svc-" + slug.Make(companyName) + "-" + slug.Make(sa.Name)
+	suffix := ""
+
+	sa.Password = generatePassword(16, 2, 2, 2)
+	passwordHash, err := hashApiPassword(sa.Password)
+	if err != nil {
+		return err
+	}
+
+	for {
+		err := db.pool.QueryRow(ctx, `
+			INSERT INTO api_credentials (user_id, contractor_id, supplier_id, created_by, name, login, enabled, password_hash, scopes, expires_at, date_created, date_updated) 
+				VALUES (NULL, NULLIF($1, 0), NULLIF($2, 0), $3, $4, $5, TRUE, $6, $7, $8, NOW(), NOW())
+			RETURNING id, login, enabled, date_created`,
+			sa.ContractorId, sa.SupplierId, sa.CreatedBy, sa.Name, login+suffix, passwordHash, sa.Scopes, sa.ExpiresAt).Scan(&sa.Id, &sa.Login, &sa.Enabled, &sa.DateCreated)
+
+		if err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+				if pgErr.ConstraintName == "api_credentials_service_account_name_idx" {
+					return fmt.Errorf("Service account named '%s' already exists", sa.Name)
+				}
+				suffix = strconv.Itoa(rand.Intn(100))
+				continue
+			}
+			return fmt.Errorf("Failed to create service account: %v", err)
+		}
+		break
+	}
+
+	return nil
+}
+
+// enables/disables service account and optionally generates new password, which is returned only here
+func (db *CrutchDBHelper) updateServiceAccount(ctx context.Context, contractorId int, supplierId int, id int, enabled *bool, rotatePassword bool, gracePeriod time.Duration) (*ServiceAccount, error) {
+
+	sa := ServiceAccount{}
+	query := `
+		UPDATE api_credentials SET 
+			enabled=COALESCE($1, enabled), 
+			date_updated=NOW() 
+		WHERE id=$2 AND user_id IS NULL AND COALESCE(contractor_id, 0)=$3 AND COALESCE(supplier_id, 0)=$4 AND date_revoked IS NULL`
+	args := []interface{}{enabled, id, contractorId, supplierId}
+
+	if rotatePassword {
+		sa.Password = generatePassword(16, 2, 2, 2)
+		passwordHash, err := hashApiPassword(sa.Password)
+		if err != nil {
+			return nil, err
+		}
+
+		query = `
+		UPDATE api_credentials SET 
+			enabled=COALESCE($1, enabled), 
+			password_hash=$5, 
+			date_updated=NOW(), ` + keepPreviousPassword("$6") + ` 
+		WHERE id=$2 AND user_id IS NULL AND COALESCE(contractor_id, 0)=$3 AND COALESCE(supplier_id, 0)=$4 AND date_revoked IS NULL`
+		args = append(args, passwordHash, int(gracePeriod.Seconds()))
+	}
+
+	err := db.pool.QueryRow(ctx, query+`
+		RETURNING id, name, login, enabled, scopes, expires_at, COALESCE(contractor_id, 0), COALESCE(supplier_id, 0), COALESCE(created_by, 0), date_created, last_used_at, previous_expires_at, previous_last_used_at`,
+		args...).Scan(&sa.Id, &sa.Name, &sa.Login, &sa.Enabled, &sa.Scopes, &sa.ExpiresAt, &sa.ContractorId, &sa.SupplierId, &sa.CreatedBy, &sa.DateCreated, &sa.LastUsedAt, &sa.PreviousExpiresAt, &sa.PreviousLastUsedAt)
+	if err != nil {
+		return nil, fmt.Errorf("Service account %v does not exist: %v", id, err)
+	}
+
+	return &sa, nil
+}
+
+func (db *CrutchDBHelper) revokeServiceAccount(ctx context.Context, contractorId int, supplierId int, id int) (string, error) {
+	var login string
+	err := db.pool.QueryRow(ctx, `
+		UPDATE api_credentials SET date_revoked=NOW(), enabled=FALSE, date_updated=NOW() 
+		WHERE id=$1 AND user_id IS NULL AND COALESCE(contractor_id, 0)=$2 AND COALESCE(supplier_id, 0)=$3 AND date_revoked IS NULL 
+		RETURNING login`, id, contractorId, supplierId).Scan(&login)
+	if err != nil {
+		return "", fmt.Errorf("Service account %v does not exist: %v", id, err)
+	}
 
-	return user_id, password, err
+	return login, nil
 }
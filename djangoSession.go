@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// django.contrib.sessions.backends.db.SessionStore salts
+const (
+	djangoSessionSalt       = "django.contrib.sessions.SessionStore"
+	djangoLegacySessionSalt = "django.contrib.sessionsSessionStore"
+	djangoSessionAuthSalt   = "django.contrib.auth.models.AbstractBaseUser.get_session_auth_hash"
+)
+
+type djangoSession struct {
+	UserId       int
+	AuthUserHash string
+	CompareList  string
+}
+
+// salted_hmac from django.utils.crypto
+func djangoSaltedHmac(keySalt string, value []byte, secret string, h func() hash.Hash) []byte {
+	hasher := h()
+	hasher.Write([]byte(keySalt + secret))
+	mac := hmac.New(h, hasher.Sum(nil))
+	mac.Write(value)
+	return mac.Sum(nil)
+}
+
+// decodes session_data the same way Django does, signature is checked against each of secret keys
+// (SECRET_KEY and SECRET_KEY_FALLBACKS), supported formats are:
+// - signing.dumps with sha256 signature (Django 3.1+)
+// - signing.dumps with sha1 signature (Django 3.1 with DEFAULT_HASHING_ALGORITHM = 'sha1')
+// - legacy base64 encoded "hash:data" (before Django 3.1)
+// without secret keys signature is not checked, see DJANGO_SESSION_SIGNATURE_CHECK
+func decodeDjangoSession(sessionData string, secretKeys []string) (*djangoSession, error) {
+	payload, err := djangoUnsign(sessionData, secretKeys)
+	if err != nil {
+		payload, err = djangoLegacyDecode(sessionData, secretKeys)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var data struct {
+		UserID       json.RawMessage `json:"_auth_user_id"`
+		AuthUserHash string          `json:"_auth_user_hash"`
+		CompareList  string          `json:"compare_list"`
+	}
+	err = json.Unmarshal(payload, &data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse session data: %v", err)
+	}
+
+	// Django keeps user id as string, but be ready to get number as well
+	userId, err := strconv.Atoi(strings.Trim(string(data.UserID), `"`))
+	if err != nil {
+		return nil, fmt.Errorf("Session is not authenticated")
+	}
+
+	return &djangoSession{userId, data.AuthUserHash, data.CompareList}, nil
+}
+
+// signing.loads from django.core.signing
+func djangoUnsign(signed string, secretKeys []string) ([]byte, error) {
+	i := strings.LastIndex(signed, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("No signature found")
+	}
+	value, signature := signed[:i], signed[i+1:]
+
+	valid := len(secretKeys) == 0
+	for _, secret := range secretKeys {
+		for _, h := range []func() hash.Hash{sha256.New, sha1.New} {
+			expected := base64.RawURLEncoding.EncodeToString(djangoSaltedHmac(djangoSessionSalt+"signer", []byte(value), secret, h))
+			if hmac.Equal([]byte(expected), []byte(signature)) {
+				valid = true
+			}
+		}
+	}
+	if !valid {
+		return nil, fmt.Errorf("Session signature does not match")
+	}
+
+	// strip timestamp, session expiration is controlled by expire_date
+	i = strings.LastIndex(value, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("No timestamp found")
+	}
+	value = value[:i]
+
+	compressed := strings.HasPrefix(value, ".")
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(value, "."))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode session data: %v", err)
+	}
+
+	if compressed {
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decompress session data: %v", err)
+		}
+		defer zr.Close()
+
+		data, err = ioutil.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decompress session data: %v", err)
+		}
+	}
+
+	return data, nil
+}
+
+// SessionBase._legacy_decode from django.contrib.sessions
+func djangoLegacyDecode(sessionData string, secretKeys []string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(sessionData)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode session data: %v", err)
+	}
+
+	i := bytes.IndexByte(decoded, ':')
+	if i < 0 {
+		return nil, fmt.Errorf("Session data is corrupted")
+	}
+	signature, serialized := decoded[:i], decoded[i+1:]
+	if len(secretKeys) == 0 {
+		return serialized, nil
+	}
+
+	for _, secret := range secretKeys {
+		expected := hex.EncodeToString(djangoSaltedHmac(djangoLegacySessionSalt, serialized, secret, sha1.New))
+		if hmac.Equal([]byte(expected), signature) {
+			return serialized, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Session signature does not match")
+}
+
+// AbstractBaseUser.get_session_auth_hash, it changes when user changes password
+// and Django drops sessions created before that
+func checkDjangoSessionAuthHash(authHash string, passwordHash string, secretKeys []string) bool {
+	for _, secret := range secretKeys {
+		for _, h := range []func() hash.Hash{sha256.New, sha1.New} {
+			expected := hex.EncodeToString(djangoSaltedHmac(djangoSessionAuthSalt, []byte(passwordHash), secret, h))
+			if hmac.Equal([]byte(expected), []byte(authHash)) {
+				return true
+			}
+		}
+	}
+	return false
+}
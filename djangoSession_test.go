@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeDjangoSession(t *testing.T) {
+	secretKeys := []string{"test-secret-key"}
+
+	t.Run("Сессия Django 3.1+ (sha256, сжатая)", func(t *testing.T) {
+		data := ".eJyrVopPLC3JiC8tTi2Kz0xRslIyV9JBFktKTM5OzQNJpGQl5qXn6yXn55UUZSbpgZToQWWL9XzzU1JznKBqUQzISCzOAOquAIom5-cWJBalxudkFpcAhRKTkslGSrUAdoBDsw:1ma62i:gt-cgYctgMUKDhtwUsTTJ6psNuWT6XiJ4ygmldZ9eiI"
+		session, err := decodeDjangoSession(data, secretKeys)
+		if err != nil {
+			t.Fatalf("Failed to decode session - %v", err)
+		}
+
+		if session.UserId != 7 || session.AuthUserHash != "x" || session.CompareList != strings.Repeat("abc", 20) {
+			t.Errorf("Got wrong session data - %+v", session)
+		}
+	})
+
+	t.Run("Сессия Django 3.1 с DEFAULT_HASHING_ALGORITHM='sha1'", func(t *testing.T) {
+		data := "eyJfYXV0aF91c2VyX2lkIjoiMTQifQ:1ma62i:MQUbLS_0c_kDtLd9Zfd4Ed-kOKE"
+		session, err := decodeDjangoSession(data, secretKeys)
+		if err != nil {
+			t.Fatalf("Failed to decode session - %v", err)
+		}
+
+		if session.UserId != 14 {
+			t.Errorf("Got wrong user id %v instead of 14", session.UserId)
+		}
+	})
+
+	t.Run("Сессия в старом формате (до Django 3.1)", func(t *testing.T) {
+		data := "ZGFiODZkMmIzZjhhOGZlNzZhOTQ3Nzg2MGY3OWYzOWIyODkzYzcxYTp7Il9hdXRoX3VzZXJfaWQiOiI0NjQiLCJjb21wYXJlX2xpc3QiOiJjbCJ9"
+		session, err := decodeDjangoSession(data, secretKeys)
+		if err != nil {
+			t.Fatalf("Failed to decode session - %v", err)
+		}
+
+		if session.UserId != 464 || session.CompareList != "cl" {
+			t.Errorf("Got wrong session data - %+v", session)
+		}
+	})
+
+	t.Run("Подпись другим ключом отвергается", func(t *testing.T) {
+		data := "eyJfYXV0aF91c2VyX2lkIjoiMTQifQ:1ma62i:MQUbLS_0c_kDtLd9Zfd4Ed-kOKE"
+		if _, err := decodeDjangoSession(data, []string{"another-key"}); err == nil {
+			t.Errorf("Session signed with another key was accepted")
+		}
+
+		// but it is accepted when key is listed among fallbacks
+		if _, err := decodeDjangoSession(data, []string{"another-key", "test-secret-key"}); err != nil {
+			t.Errorf("Session signed with fallback key was rejected - %v", err)
+		}
+	})
+
+	t.Run("Изменённые данные сессии отвергаются", func(t *testing.T) {
+		data := "eyJfYXV0aF91c2VyX2lkIjoiMSJ9:1ma62i:MQUbLS_0c_kDtLd9Zfd4Ed-kOKE"
+		if _, err := decodeDjangoSession(data, secretKeys); err == nil {
+			t.Errorf("Tampered session was accepted")
+		}
+	})
+
+	t.Run("Без ключей подпись не проверяется", func(t *testing.T) {
+		for _, data := range []string{
+			"eyJfYXV0aF91c2VyX2lkIjoiMSJ9:1ma62i:MQUbLS_0c_kDtLd9Zfd4Ed-kOKE",
+			"ZGFiODZkMmIzZjhhOGZlNzZhOTQ3Nzg2MGY3OWYzOWIyODkzYzcxYTp7Il9hdXRoX3VzZXJfaWQiOiI0NjQiLCJjb21wYXJlX2xpc3QiOiJjbCJ9",
+		} {
+			if _, err := decodeDjangoSession(data, nil); err != nil {
+				t.Errorf("Session was rejected without secret keys - %v", err)
+			}
+		}
+	})
+
+	t.Run("Хэш пароля в сессии", func(t *testing.T) {
+		authHash := "d51edc3e4cc8f9d3ed99493e2cb462b477619b902e1d6f51c2653dbe55e1c12a"
+		if !checkDjangoSessionAuthHash(authHash, "pbkdf2_sha256$260000$salt$hash", secretKeys) {
+			t.Errorf("Valid session auth hash was rejected")
+		}
+		if checkDjangoSessionAuthHash(authHash, "pbkdf2_sha256$260000$salt$changed", secretKeys) {
+			t.Errorf("Session auth hash was accepted after password change")
+		}
+	})
+}
@@ -129,9 +129,316 @@ var doc = `{
                     }
                 }
             }
+        },
+        "/products": {
+            "get": {
+                "description": "Full text search with multi-select facets. Pages are requested either by number within the first 10000 hits, or with cursor of the previous page which reaches the rest.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "products"
+                ],
+                "summary": "Search products",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Search text",
+                        "name": "text",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 0,
+                        "description": "Page number",
+                        "name": "page",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Cursor of the previous page, page is ignored when it is set",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "City to check stock in",
+                        "name": "cityId",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Only products in stock",
+                        "name": "inStock",
+                        "in": "query"
+                    },
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "description": "Categories selected in facets",
+                        "name": "categories[]",
+                        "in": "query"
+                    },
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "description": "Suppliers selected in facets",
+                        "name": "suppliers[]",
+                        "in": "query"
+                    },
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "description": "Properties selected in facets, as name=value",
+                        "name": "properties[]",
+                        "in": "query"
+                    },
+                    {
+                        "type": "number",
+                        "description": "Lower price bound without tax",
+                        "name": "priceMin",
+                        "in": "query"
+                    },
+                    {
+                        "type": "number",
+                        "description": "Upper price bound without tax",
+                        "name": "priceMax",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "relevance",
+                            "price_asc",
+                            "price_desc",
+                            "rest",
+                            "name"
+                        ],
+                        "type": "string",
+                        "default": "relevance",
+                        "description": "Order of results",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Do not search for corrected text when nothing is found",
+                        "name": "noAutoCorrect",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.SearchResults"
+                        }
+                    }
+                }
+            }
+        },
+        "/products/lookup": {
+            "post": {
+                "description": "Finds product for each code of the list, e.g. of bill of materials. Codes are compared without spaces and dashes, Cyrillic letters looking like Latin ones are treated as Latin. When there is no exact match, the closest code is returned with match \"fuzzy\".",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "products"
+                ],
+                "summary": "Look up products by codes",
+                "parameters": [
+                    {
+                        "description": "Codes with optional quantities, up to 500",
+                        "name": "params",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.LookupParams"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/main.LookupResult"
+                            }
+                        }
+                    }
+                }
+            }
+        },
+        "/token": {
+            "post": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    }
+                ],
+                "description": "Exchanges API credentials (grant_type=client_credentials with basic auth) or refresh token (grant_type=refresh_token) for bearer access token and new refresh token. Refresh token is accepted only once, access token stops working when API credentials change.",
+                "consumes": [
+                    "application/x-www-form-urlencoded"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "auth"
+                ],
+                "summary": "Issue access token",
+                "parameters": [
+                    {
+                        "enum": [
+                            "client_credentials",
+                            "refresh_token"
+                        ],
+                        "type": "string",
+                        "description": "Grant type",
+                        "name": "grant_type",
+                        "in": "formData",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Refresh token, required for refresh_token grant",
+                        "name": "refresh_token",
+                        "in": "formData"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.tokenResponse"
+                        }
+                    }
+                }
+            }
         }
     },
     "definitions": {
+        "main.City": {
+            "type": "object",
+            "properties": {
+                "id": {
+                    "type": "integer"
+                },
+                "name": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.FacetBucket": {
+            "type": "object",
+            "properties": {
+                "count": {
+                    "type": "integer"
+                },
+                "selected": {
+                    "type": "boolean"
+                },
+                "value": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.Facets": {
+            "type": "object",
+            "properties": {
+                "categories": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.FacetBucket"
+                    }
+                },
+                "properties": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.PropertyFacet"
+                    }
+                },
+                "suppliers": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.FacetBucket"
+                    }
+                }
+            }
+        },
+        "main.Impersonator": {
+            "type": "object",
+            "properties": {
+                "email": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "name": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.LookupItem": {
+            "type": "object",
+            "properties": {
+                "code": {
+                    "type": "string"
+                },
+                "quantity": {
+                    "description": "1 when not set",
+                    "type": "number"
+                }
+            }
+        },
+        "main.LookupParams": {
+            "type": "object",
+            "properties": {
+                "cityId": {
+                    "type": "integer"
+                },
+                "items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.LookupItem"
+                    }
+                }
+            }
+        },
+        "main.LookupResult": {
+            "type": "object",
+            "properties": {
+                "code": {
+                    "description": "as requested",
+                    "type": "string"
+                },
+                "match": {
+                    "description": "exact, fuzzy or none",
+                    "type": "string"
+                },
+                "product": {
+                    "$ref": "#/definitions/main.SearchResultEntry"
+                },
+                "quantity": {
+                    "type": "number"
+                },
+                "sufficient": {
+                    "description": "rest of product in warehouses available to user covers quantity",
+                    "type": "boolean"
+                }
+            }
+        },
         "main.OrderDetails": {
             "type": "object",
             "properties": {
@@ -141,6 +448,9 @@ var doc = `{
                 "buyer": {
                     "type": "string"
                 },
+                "buyer_email": {
+                    "type": "string"
+                },
                 "buyer_id": {
                     "type": "integer"
                 },
@@ -290,6 +600,197 @@ var doc = `{
                     "type": "number"
                 }
             }
+        },
+        "main.PropertyFacet": {
+            "type": "object",
+            "properties": {
+                "name": {
+                    "type": "string"
+                },
+                "values": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.FacetBucket"
+                    }
+                }
+            }
+        },
+        "main.SearchResultEntry": {
+            "type": "object",
+            "properties": {
+                "category": {
+                    "type": "string"
+                },
+                "code": {
+                    "type": "string"
+                },
+                "description": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "image": {
+                    "type": "string"
+                },
+                "modification_id": {
+                    "type": "integer"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "price": {
+                    "type": "number"
+                },
+                "rest": {
+                    "type": "number"
+                },
+                "score": {
+                    "type": "number"
+                },
+                "supplier": {
+                    "type": "string"
+                },
+                "warehouse_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "main.SearchResults": {
+            "type": "object",
+            "properties": {
+                "admin": {
+                    "type": "boolean"
+                },
+                "allowed_ips": {
+                    "description": "CIDRs API credentials are restricted to",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "api_login": {
+                    "type": "string"
+                },
+                "auth_method": {
+                    "type": "string"
+                },
+                "backend": {
+                    "description": "search backend which served the response, either elastic or postgres",
+                    "type": "string"
+                },
+                "can_read_buyers": {
+                    "type": "boolean"
+                },
+                "can_read_orders": {
+                    "type": "boolean"
+                },
+                "can_read_sellers": {
+                    "type": "boolean"
+                },
+                "capabilities": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "cities": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.City"
+                    }
+                },
+                "company_admin": {
+                    "type": "boolean"
+                },
+                "compare_list": {
+                    "type": "string"
+                },
+                "contractor": {
+                    "type": "string"
+                },
+                "contractor_id": {
+                    "type": "integer"
+                },
+                "corrected": {
+                    "type": "boolean"
+                },
+                "correction": {
+                    "type": "string"
+                },
+                "cursor": {
+                    "description": "to request the page after Page",
+                    "type": "string"
+                },
+                "didYouMean": {
+                    "description": "corrected text when original one finds few products, Corrected means results are found by it;\nCorrection is either layout, transliteration or spelling",
+                    "type": "string"
+                },
+                "email": {
+                    "type": "string"
+                },
+                "facets": {
+                    "$ref": "#/definitions/main.Facets"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "impersonated_by": {
+                    "description": "set when superuser acts as this user",
+                    "$ref": "#/definitions/main.Impersonator"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "page": {
+                    "type": "integer"
+                },
+                "results": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.SearchResultEntry"
+                    }
+                },
+                "scopes": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "service_account": {
+                    "description": "API credentials of contractor or supplier company, Id is 0",
+                    "type": "boolean"
+                },
+                "staff": {
+                    "type": "boolean"
+                },
+                "supplier": {
+                    "type": "string"
+                },
+                "supplier_id": {
+                    "type": "integer"
+                },
+                "totalPages": {
+                    "type": "integer"
+                }
+            }
+        },
+        "main.tokenResponse": {
+            "type": "object",
+            "properties": {
+                "access_token": {
+                    "type": "string"
+                },
+                "expires_in": {
+                    "type": "integer"
+                },
+                "refresh_token": {
+                    "type": "string"
+                },
+                "token_type": {
+                    "type": "string"
+                }
+            }
         }
     },
     "securityDefinitions": {
@@ -3,15 +3,43 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"strconv"
 
 	"github.com/elastic/go-elasticsearch/v5"
+	"github.com/elastic/go-elasticsearch/v5/esapi"
 )
 
+const (
+	productIndex = "severstal_product"
+	// point in time is kept open between pages of infinite scroll
+	pitKeepAlive = "5m"
+	// from/size paging does not reach beyond index.max_result_window
+	maxResultWindow = 10000
+)
+
+var errCursorExpired = errors.New("Search cursor has expired, please start the search again")
+
+// error response of ES, 4xx ones are caused by request rather than by state of ES
+type elasticError struct {
+	StatusCode int
+	message    string
+}
+
+func (e *elasticError) Error() string {
+	return e.message
+}
+
 type ElasticHelper struct {
-	client *elasticsearch.Client
+	client  *elasticsearch.Client
+	mapping mappingState // see watchMapping
 }
 
 type SearchQuery struct {
@@ -24,6 +52,156 @@ type SearchQuery struct {
 	CityID      int    `json:"cityId"`
 	InStockOnly bool   `json:"inStock"`
 	Supplier    string `json:"supplier"`
+	// multi-select facet filters, see facets.go
+	Categories []string `json:"categories" schema:"categories[]"`
+	Suppliers  []string `json:"suppliers" schema:"suppliers[]"`
+	Properties []string `json:"properties" schema:"properties[]"` // "name=value"
+	// do not search for corrected text when nothing is found
+	NoAutoCorrect bool `json:"noAutoCorrect"`
+	// continues search from SearchResults.Cursor, Page is ignored then
+	Cursor string `json:"cursor"`
+	// searched without point in time, e.g. for retries which are likely to be thrown away
+	noCursor bool
+	// price bounds without tax, zero means no bound; products without price do not pass bounds
+	PriceMin float64 `json:"priceMin"`
+	PriceMax float64 `json:"priceMax"`
+	Sort     string  `json:"sort"` // one of sort* orders, relevance when empty
+}
+
+const (
+	sortRelevance = "relevance"
+	sortPriceAsc  = "price_asc"
+	sortPriceDesc = "price_desc"
+	sortRest      = "rest" // most in stock in warehouses available to user first
+	sortName      = "name"
+)
+
+func (query *SearchQuery) checkPriceAndSort() error {
+	switch query.Sort {
+	case "", sortRelevance, sortPriceAsc, sortPriceDesc, sortRest, sortName:
+	default:
+		return fmt.Errorf("Unknown sort order '%s', expected one of %s, %s, %s, %s, %s",
+			query.Sort, sortRelevance, sortPriceAsc, sortPriceDesc, sortRest, sortName)
+	}
+
+	if query.PriceMin < 0 || query.PriceMax < 0 {
+		return fmt.Errorf("Price bounds can not be negative")
+	}
+	if query.PriceMax > 0 && query.PriceMin > query.PriceMax {
+		return fmt.Errorf("priceMin %v is greater than priceMax %v", query.PriceMin, query.PriceMax)
+	}
+
+	return nil
+}
+
+func priceRange(query *SearchQuery) map[string]interface{} {
+	bounds := map[string]interface{}{}
+	if query.PriceMin > 0 {
+		bounds["gte"] = query.PriceMin
+	}
+	if query.PriceMax > 0 {
+		bounds["lte"] = query.PriceMax
+	}
+	if len(bounds) == 0 {
+		return nil
+	}
+	return map[string]interface{}{"range": map[string]interface{}{"price": bounds}}
+}
+
+// ties are broken by score, and by _shard_doc of point in time after it; unmapped_type keeps
+// indices created before the field was added searchable
+func searchSort(query *SearchQuery, stock *StockFilter, mapping productMapping) []interface{} {
+	byScore := map[string]interface{}{"_score": "desc"}
+
+	switch query.Sort {
+	case sortPriceAsc, sortPriceDesc:
+		order := "asc"
+		if query.Sort == sortPriceDesc {
+			order = "desc"
+		}
+		return []interface{}{
+			map[string]interface{}{"price": map[string]interface{}{"order": order, "missing": "_last", "unmapped_type": "double"}},
+			byScore,
+		}
+	case sortRest:
+		// nested sort fails on availability mapped as object, relevance order is kept then
+		if !mapping.StockSynced {
+			break
+		}
+		// the same warehouses getProductEntries sums rest over
+		nested := map[string]interface{}{"path": "availability"}
+		if warehouse := stock.warehouseConditions(); len(warehouse) > 0 {
+			nested["filter"] = map[string]interface{}{"bool": map[string]interface{}{"filter": warehouse}}
+		}
+		return []interface{}{
+			map[string]interface{}{"availability.rest": map[string]interface{}{"order": "desc", "mode": "sum", "nested": nested}},
+			byScore,
+		}
+	case sortName:
+		return []interface{}{
+			map[string]interface{}{"name.sort": map[string]interface{}{"order": "asc", "unmapped_type": "keyword"}},
+			byScore,
+		}
+	}
+
+	return []interface{}{byScore}
+}
+
+// page of hits with the cursor to the next page, cursor is empty for the last page, for the first page
+// of results which fit into result window or when point in time could not be opened,
+// only from/size paging is available then
+type SearchPage struct {
+	Hits       []interface{}
+	Page       int
+	TotalPages int
+	Cursor     string
+	Facets     *Facets
+	Backend    string // name of search backend which found the hits
+	// pages are cut by result window, only point in time reaches the rest
+	truncated bool
+}
+
+// search_after values of the last hit in point in time, bound to the query it was issued for
+type searchCursor struct {
+	PitId       string        `json:"pit"`
+	SearchAfter []interface{} `json:"after"`
+	Page        int           `json:"page"`
+	Query       string        `json:"query"`
+}
+
+func queryFingerprint(query *SearchQuery) string {
+	q := *query
+	q.Page, q.Cursor = 0, ""
+	b, _ := json.Marshal(q)
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:8])
+}
+
+func encodeCursor(cursor searchCursor) string {
+	b, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// nil cursor means search from query page
+func decodeCursor(query *SearchQuery) (*searchCursor, error) {
+	if query.Cursor == "" {
+		return nil, nil
+	}
+
+	cursor := searchCursor{}
+	b, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+	if err == nil {
+		err = json.Unmarshal(b, &cursor)
+	}
+	if err != nil || cursor.PitId == "" || len(cursor.SearchAfter) == 0 {
+		return nil, fmt.Errorf("Invalid search cursor")
+	}
+
+	if cursor.Query != queryFingerprint(query) {
+		return nil, fmt.Errorf("Search cursor was issued for another query")
+	}
+
+	return &cursor, nil
 }
 
 func initElasticHelper(addr string) (*ElasticHelper, error) {
@@ -43,12 +221,121 @@ func initElasticHelper(addr string) (*ElasticHelper, error) {
 	log.Println(elasticsearch.Version)
 	log.Debug(client.Info())
 
-	es := ElasticHelper{client}
+	es := ElasticHelper{client: client}
 
 	return &es, nil
 }
 
-func (es *ElasticHelper) search(query *SearchQuery, ctx context.Context) (hits []interface{}, totalPages int, err error) {
+// raw request for APIs the client does not cover, body and result are JSON encoded
+func (es *ElasticHelper) perform(ctx context.Context, method string, path string, body interface{}, result interface{}) error {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return fmt.Errorf("Error encoding request: %v", err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, path, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := es.client.Perform(req)
+	if err != nil {
+		return fmt.Errorf("Error getting response: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		b, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("%s %s failed: [%s] %s", method, path, res.Status, b)
+	}
+
+	if result != nil {
+		if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+			return fmt.Errorf("Error parsing elastic response: %v", err)
+		}
+	}
+	return nil
+}
+
+func (es *ElasticHelper) openPointInTime(ctx context.Context) (string, error) {
+	var pit struct {
+		Id string `json:"id"`
+	}
+	err := es.perform(ctx, "POST", "/"+productIndex+"/_pit?keep_alive="+pitKeepAlive, nil, &pit)
+	if err != nil {
+		return "", fmt.Errorf("Failed to open point in time: %v", err)
+	}
+	return pit.Id, nil
+}
+
+func (es *ElasticHelper) closePointInTime(ctx context.Context, pitId string) {
+	err := es.perform(ctx, "DELETE", "/_pit", map[string]interface{}{"id": pitId}, nil)
+	if err != nil {
+		log.Warn("Failed to close point in time: ", err)
+	}
+}
+
+// point in time is opened only when from/size paging is not enough: for pages beyond the first
+// and for the first page with more hits than result window; following pages are read with
+// search_after from the cursor
+func (es *ElasticHelper) search(query *SearchQuery, stock *StockFilter, ctx context.Context) (*SearchPage, error) {
+
+	cursor, err := decodeCursor(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if cursor != nil {
+		return es.searchPage(query, stock, cursor, cursor.PitId, false, ctx)
+	}
+	if query.noCursor {
+		return es.searchPage(query, stock, nil, "", false, ctx)
+	}
+	if query.Page > 0 {
+		return es.searchPointInTime(query, stock, ctx)
+	}
+
+	// most searches fit into result window, so the first page is searched again only for the rest
+	sp, err := es.searchPage(query, stock, nil, "", false, ctx)
+	if err != nil || !sp.truncated {
+		return sp, err
+	}
+	pitPage, err := es.searchPointInTime(query, stock, ctx)
+	if err != nil {
+		log.Warn(err, ", pages are limited by result window")
+		return sp, nil
+	}
+	return pitPage, nil
+}
+
+func (es *ElasticHelper) searchPointInTime(query *SearchQuery, stock *StockFilter, ctx context.Context) (*SearchPage, error) {
+	pitId, err := es.openPointInTime(ctx)
+	if err != nil {
+		log.Warn(err, ", falling back to from/size paging")
+		return es.searchPage(query, stock, nil, "", false, ctx)
+	}
+	return es.searchPage(query, stock, nil, pitId, true, ctx)
+}
+
+// stock filter applies to hits and facets, selected facets filter hits but not the aggregations
+func (es *ElasticHelper) searchPage(query *SearchQuery, stock *StockFilter, cursor *searchCursor, pitId string, opened bool, ctx context.Context) (*SearchPage, error) {
+
+	sp := SearchPage{Page: query.Page, Backend: es.name()}
+	if cursor != nil {
+		sp.Page = cursor.Page
+	}
+
+	// point in time not handed out in cursor, e.g. for single page or the last one, is closed right away
+	// instead of holding segments for keep alive; cursor of client survives failed request to be retried
+	done := false
+	defer func() {
+		if pitId != "" && sp.Cursor == "" && (opened || done) {
+			go es.closePointInTime(context.Background(), pitId)
+		}
+	}()
 
 	mustRequirementAnd := map[string]interface{}{
 		"simple_query_string": map[string]interface{}{
@@ -118,6 +405,12 @@ func (es *ElasticHelper) search(query *SearchQuery, ctx context.Context) (hits [
 		)
 	}
 
+	mapping := es.productMapping()
+	filters := es.stockFilters(stock)
+	if price := priceRange(query); price != nil {
+		filters = append(filters, price)
+	}
+
 	var buf bytes.Buffer
 	q := map[string]interface{}{
 		"query": map[string]interface{}{
@@ -143,40 +436,73 @@ func (es *ElasticHelper) search(query *SearchQuery, ctx context.Context) (hits [
 					},
 				},
 				"minimum_should_match": 1,
+				"filter":               filters,
 			},
 		},
-		"size": strconv.Itoa(itemsPerPage),
-		"from": strconv.Itoa(query.Page * itemsPerPage),
+		"aggs":             facetAggregations(query, mapping),
+		"size":             strconv.Itoa(itemsPerPage),
+		"from":             strconv.Itoa(query.Page * itemsPerPage),
+		"track_total_hits": true,
+		"sort":             searchSort(query, stock, mapping),
+		// score is still wanted for ties and the response when sorting by field
+		"track_scores": true,
+	}
+
+	if pitId != "" {
+		// hits with equal sort values are ordered by implicit _shard_doc tiebreaker of point in time
+		q["pit"] = map[string]interface{}{"id": pitId, "keep_alive": pitKeepAlive}
+	}
+	if cursor != nil {
+		q["search_after"] = cursor.SearchAfter
+		q["from"] = "0"
+	}
+
+	if filters := facetFilters(query, "", mapping); len(filters) > 0 {
+		q["post_filter"] = map[string]interface{}{
+			"bool": map[string]interface{}{"filter": filters},
+		}
 	}
 
 	if err := json.NewEncoder(&buf).Encode(q); err != nil {
-		return nil, 0, fmt.Errorf("Error encoding query: %v", err)
+		return nil, fmt.Errorf("Error encoding query: %v", err)
 	}
 
 	log.Debug("Quering elastic: ", buf.String())
 
-	res, err := es.client.Search(
+	options := []func(*esapi.SearchRequest){
 		es.client.Search.WithContext(ctx),
-		es.client.Search.WithIndex("severstal_product"),
-		es.client.Search.WithDocumentType("_doc"),
 		es.client.Search.WithBody(&buf),
-	)
+	}
+	// point in time already refers to the index
+	if pitId == "" {
+		options = append(options,
+			es.client.Search.WithIndex(productIndex),
+			es.client.Search.WithDocumentType("_doc"),
+		)
+	}
+
+	res, err := es.client.Search(options...)
 	if err != nil {
 		err = fmt.Errorf("Error getting response: %v", err)
-		return nil, 0, err
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if cursor != nil && res.StatusCode == http.StatusNotFound {
+		return nil, errCursorExpired
 	}
 
 	if res.IsError() {
 		var e map[string]interface{}
 		if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
-			return nil, 0, fmt.Errorf("Error parsing the response body: %v", err)
+			return nil, fmt.Errorf("Error parsing the response body: %v", err)
 		} else {
 			// Print the response status and error information.
-			return nil, 0, fmt.Errorf("[%s] %s: %s",
+			return nil, &elasticError{res.StatusCode, fmt.Sprintf("[%s] %s: %s",
 				res.Status(),
-				e["error"].(map[string]interface{})["type"],
-				e["error"].(map[string]interface{})["reason"],
-			)
+				aggregation(e, "error")["type"],
+				aggregation(e, "error")["reason"],
+			)}
 		}
 	}
 
@@ -184,28 +510,117 @@ func (es *ElasticHelper) search(query *SearchQuery, ctx context.Context) (hits [
 
 	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
 		err = fmt.Errorf("Error parsing elastic response: %v", err)
-		return nil, 0, err
+		return nil, err
 	}
 
 	total := int(response["hits"].(map[string]interface{})["total"].(map[string]interface{})["value"].(float64))
 
-	//temp workaround
-	if total > 10000 {
-		total = 10000
+	// without point in time pages are reachable only within result window
+	if pitId == "" && total > maxResultWindow {
+		total = maxResultWindow
+		sp.truncated = true
 	}
 
-	totalPages = total / itemsPerPage
-	if totalPages*itemsPerPage < total {
-		totalPages++
+	sp.TotalPages = total / itemsPerPage
+	if sp.TotalPages*itemsPerPage < total {
+		sp.TotalPages++
 	}
 	log.Debug("Status: ", res.Status(),
 		", hits: ", total,
-		", pages: ", totalPages,
+		", page: ", sp.Page,
+		", pages: ", sp.TotalPages,
 		", items per page:", itemsPerPage,
 		", iTook (ms): ", int(response["took"].(float64)),
 	)
 
-	hits = response["hits"].(map[string]interface{})["hits"].([]interface{})
+	sp.Hits = response["hits"].(map[string]interface{})["hits"].([]interface{})
+
+	// point in time id may change between requests, the latest one is to be used
+	if id, ok := response["pit_id"].(string); ok && id != "" {
+		pitId = id
+	}
+
+	if pitId != "" && len(sp.Hits) > 0 && sp.Page < sp.TotalPages-1 {
+		last, _ := sp.Hits[len(sp.Hits)-1].(map[string]interface{})
+		if searchAfter, ok := last["sort"].([]interface{}); ok {
+			sp.Cursor = encodeCursor(searchCursor{pitId, searchAfter, sp.Page + 1, queryFingerprint(query)})
+		}
+	}
+
+	aggs, _ := response["aggregations"].(map[string]interface{})
+	sp.Facets = parseFacets(query, aggs)
+
+	done = true
+	return &sp, nil
+}
+
+type bulkDoc struct {
+	Id  int
+	Doc interface{}
+}
+
+// action is either "index" to replace documents or "update" to update them partially,
+// returns ids of failed documents and number of documents missing in index
+func (es *ElasticHelper) bulk(ctx context.Context, index string, action string, docs []bulkDoc) (failed map[int]bool, notFound int, err error) {
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, d := range docs {
+		if err := encoder.Encode(map[string]interface{}{action: map[string]interface{}{"_id": strconv.Itoa(d.Id)}}); err != nil {
+			return nil, 0, fmt.Errorf("Error encoding bulk request: %v", err)
+		}
+		source := d.Doc
+		if action == "update" {
+			source = map[string]interface{}{"doc": d.Doc}
+		}
+		if err := encoder.Encode(source); err != nil {
+			return nil, 0, fmt.Errorf("Error encoding bulk request: %v", err)
+		}
+	}
+
+	res, err := es.client.Bulk(
+		&buf,
+		es.client.Bulk.WithContext(ctx),
+		es.client.Bulk.WithIndex(index),
+		es.client.Bulk.WithDocumentType("_doc"),
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Error getting response: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, 0, fmt.Errorf("Bulk request failed: %s", res.Status())
+	}
+
+	var response struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Id     string      `json:"_id"`
+			Status int         `json:"status"`
+			Error  interface{} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, 0, fmt.Errorf("Error parsing elastic response: %v", err)
+	}
+
+	failed = make(map[int]bool)
+	if !response.Errors {
+		return failed, 0, nil
+	}
+
+	for _, item := range response.Items {
+		for _, result := range item {
+			if result.Status == http.StatusNotFound {
+				notFound++
+			} else if result.Error != nil {
+				id, _ := strconv.Atoi(result.Id)
+				failed[id] = true
+				log.Error("Failed to ", action, " product ", result.Id, ": ", result.Error)
+			}
+		}
+	}
 
-	return hits, totalPages, nil
+	return failed, notFound, nil
 }
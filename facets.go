@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// facets are built on keyword sub-fields; properties are mapped as nested in conf/elastic/product_index.json
+// (with include_in_parent, so plain queries on properties keep working) to keep property names and values paired,
+// facets whose fields the index behind alias lacks are left out, see productMapping
+const (
+	categoryFacetField      = "category.name.keyword"
+	supplierFacetField      = "supplier.name.keyword"
+	propertiesPath          = "properties"
+	propertyNameFacetField  = "properties.property.name.keyword"
+	propertyValueFacetField = "properties.value.keyword"
+	facetSize               = 30
+	propertyValuesSize      = 20
+)
+
+type FacetBucket struct {
+	Value    string `json:"value"`
+	Count    int    `json:"count"`
+	Selected bool   `json:"selected"`
+}
+
+type PropertyFacet struct {
+	Name   string        `json:"name"`
+	Values []FacetBucket `json:"values"`
+}
+
+// counts are numbers of products available to user according to the index
+type Facets struct {
+	Categories []FacetBucket   `json:"categories"`
+	Suppliers  []FacetBucket   `json:"suppliers"`
+	Properties []PropertyFacet `json:"properties"`
+}
+
+// selected property values grouped by property name, values come as "name=value"
+func (query *SearchQuery) selectedProperties() (names []string, values map[string][]string) {
+	values = make(map[string][]string)
+	for _, p := range query.Properties {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		if _, found := values[kv[0]]; !found {
+			names = append(names, kv[0])
+		}
+		values[kv[0]] = append(values[kv[0]], kv[1])
+	}
+	sort.Strings(names)
+	return names, values
+}
+
+func propertyFilter(name string, values []string) map[string]interface{} {
+	return map[string]interface{}{
+		"nested": map[string]interface{}{
+			"path": propertiesPath,
+			"query": map[string]interface{}{
+				"bool": map[string]interface{}{
+					"filter": []interface{}{
+						map[string]interface{}{"term": map[string]interface{}{propertyNameFacetField: name}},
+						map[string]interface{}{"terms": map[string]interface{}{propertyValueFacetField: values}},
+					},
+				},
+			},
+		},
+	}
+}
+
+// filters of selected facets, values within a facet are ORed and facets are ANDed;
+// filter of the facet named by except is left out, so that its other values keep their counts
+func facetFilters(query *SearchQuery, except string, mapping productMapping) []interface{} {
+	filters := make([]interface{}, 0)
+
+	if len(query.Categories) > 0 && except != "category" {
+		filters = append(filters, map[string]interface{}{
+			"terms": map[string]interface{}{categoryFacetField: query.Categories},
+		})
+	}
+
+	if len(query.Suppliers) > 0 && except != "supplier" && mapping.SupplierKeyword {
+		filters = append(filters, map[string]interface{}{
+			"terms": map[string]interface{}{supplierFacetField: query.Suppliers},
+		})
+	}
+
+	names, values := query.selectedProperties()
+	if !mapping.NestedProperties {
+		names = nil
+	}
+	for _, name := range names {
+		if except != "property:"+name {
+			filters = append(filters, propertyFilter(name, values[name]))
+		}
+	}
+
+	return filters
+}
+
+func termsAggregation(field string, size int, aggs map[string]interface{}) map[string]interface{} {
+	agg := map[string]interface{}{
+		"terms": map[string]interface{}{"field": field, "size": size},
+	}
+	if aggs != nil {
+		agg["aggs"] = aggs
+	}
+	return agg
+}
+
+// property value buckets count nested documents, reverse_nested gives number of products
+var productsCountAggregation = map[string]interface{}{
+	"products": map[string]interface{}{"reverse_nested": map[string]interface{}{}},
+}
+
+// post_filter is applied to hits only, so every facet aggregation is filtered
+// by selections in all other facets
+func facetAggregations(query *SearchQuery, mapping productMapping) map[string]interface{} {
+
+	filtered := func(except string, agg map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"filter": map[string]interface{}{
+				"bool": map[string]interface{}{"filter": facetFilters(query, except, mapping)},
+			},
+			"aggs": map[string]interface{}{"facet": agg},
+		}
+	}
+
+	aggs := map[string]interface{}{
+		"categories": filtered("category", termsAggregation(categoryFacetField, facetSize, nil)),
+	}
+	if mapping.SupplierKeyword {
+		aggs["suppliers"] = filtered("supplier", termsAggregation(supplierFacetField, facetSize, nil))
+	}
+	// nested aggregation on object path fails the whole search
+	if !mapping.NestedProperties {
+		return aggs
+	}
+
+	aggs["properties"] = filtered("", map[string]interface{}{
+		"nested": map[string]interface{}{"path": propertiesPath},
+		"aggs": map[string]interface{}{
+			"names": termsAggregation(propertyNameFacetField, facetSize, map[string]interface{}{
+				"values": termsAggregation(propertyValueFacetField, propertyValuesSize, productsCountAggregation),
+			}),
+		},
+	})
+
+	// values of properties with selection are counted without their own filter
+	names, _ := query.selectedProperties()
+	for i, name := range names {
+		aggs["property_"+strconv.Itoa(i)] = filtered("property:"+name, map[string]interface{}{
+			"nested": map[string]interface{}{"path": propertiesPath},
+			"aggs": map[string]interface{}{
+				"name": map[string]interface{}{
+					"filter": map[string]interface{}{"term": map[string]interface{}{propertyNameFacetField: name}},
+					"aggs": map[string]interface{}{
+						"values": termsAggregation(propertyValueFacetField, propertyValuesSize, productsCountAggregation),
+					},
+				},
+			},
+		})
+	}
+
+	return aggs
+}
+
+func aggregation(aggs map[string]interface{}, path ...string) map[string]interface{} {
+	for _, key := range path {
+		aggs, _ = aggs[key].(map[string]interface{})
+	}
+	return aggs
+}
+
+// selected values are always returned, even with zero count, so that they can be unselected
+func facetBuckets(agg map[string]interface{}, selected []string) []FacetBucket {
+	buckets := make([]FacetBucket, 0)
+	found := make(map[string]bool)
+
+	raw, _ := agg["buckets"].([]interface{})
+	for _, b := range raw {
+		bucket, _ := b.(map[string]interface{})
+		value := fmt.Sprint(bucket["key"])
+
+		count, _ := bucket["doc_count"].(float64)
+		if products := aggregation(bucket, "products"); products != nil {
+			count, _ = products["doc_count"].(float64)
+		}
+
+		found[value] = true
+		buckets = append(buckets, FacetBucket{value, int(count), contains(selected, value)})
+	}
+
+	for _, value := range selected {
+		if !found[value] {
+			buckets = append(buckets, FacetBucket{value, 0, true})
+		}
+	}
+
+	return buckets
+}
+
+func parseFacets(query *SearchQuery, aggs map[string]interface{}) *Facets {
+	names, selected := query.selectedProperties()
+
+	facets := Facets{
+		Categories: facetBuckets(aggregation(aggs, "categories", "facet"), query.Categories),
+		Suppliers:  facetBuckets(aggregation(aggs, "suppliers", "facet"), query.Suppliers),
+		Properties: make([]PropertyFacet, 0),
+	}
+
+	selectedValues := make(map[string][]FacetBucket)
+	for i, name := range names {
+		agg := aggregation(aggs, "property_"+strconv.Itoa(i), "facet", "name", "values")
+		selectedValues[name] = facetBuckets(agg, selected[name])
+	}
+
+	raw, _ := aggregation(aggs, "properties", "facet", "names")["buckets"].([]interface{})
+	for _, b := range raw {
+		bucket, _ := b.(map[string]interface{})
+		name := fmt.Sprint(bucket["key"])
+
+		values, found := selectedValues[name]
+		if found {
+			delete(selectedValues, name)
+		} else {
+			values = facetBuckets(aggregation(bucket, "values"), nil)
+		}
+		facets.Properties = append(facets.Properties, PropertyFacet{name, values})
+	}
+
+	// property may be missing from common aggregation when its selection matches nothing
+	for _, name := range names {
+		if values, found := selectedValues[name]; found {
+			facets.Properties = append(facets.Properties, PropertyFacet{name, values})
+		}
+	}
+
+	return &facets
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestFacetAggregationsMapping(t *testing.T) {
+	query := &SearchQuery{Suppliers: []string{"Северсталь"}, Properties: []string{"Диаметр=10"}}
+
+	aggs := facetAggregations(query, productMapping{NestedProperties: true, SupplierKeyword: true})
+	for _, name := range []string{"categories", "suppliers", "properties", "property_0"} {
+		if aggs[name] == nil {
+			t.Errorf("Aggregation %s is missing for index with nested properties", name)
+		}
+	}
+	if filters := facetFilters(query, "", productMapping{NestedProperties: true, SupplierKeyword: true}); len(filters) != 2 {
+		t.Errorf("Got %d facet filters, want 2", len(filters))
+	}
+
+	// dynamically mapped index
+	aggs = facetAggregations(query, productMapping{})
+	if len(aggs) != 1 || aggs["categories"] == nil {
+		t.Errorf("Only category facet is expected without nested properties and supplier keyword, got %v", aggs)
+	}
+	if filters := facetFilters(query, "", productMapping{}); len(filters) != 0 {
+		t.Errorf("Got %d facet filters, want none", len(filters))
+	}
+}
+
+func TestFieldMapping(t *testing.T) {
+	mappings := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"supplier": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"name": map[string]interface{}{
+						"type":   "text",
+						"fields": map[string]interface{}{"keyword": map[string]interface{}{"type": "keyword"}},
+					},
+				},
+			},
+		},
+	}
+
+	if fieldMapping(mappings, "supplier.name.keyword") == nil {
+		t.Errorf("Keyword sub-field is not found")
+	}
+	if fieldMapping(mappings, "supplier.id") != nil || fieldMapping(mappings, "category.name.keyword") != nil {
+		t.Errorf("Missing field is found")
+	}
+}
@@ -12,6 +12,7 @@ require github.com/jackc/pgx/v4 v4.13.1-0.20210809134107-23b4656fc573
 
 require (
 	github.com/go-openapi/spec v0.20.4 // indirect
+	github.com/golang-jwt/jwt/v4 v4.1.0
 	github.com/gorilla/context v1.1.1
 	github.com/gorilla/csrf v1.7.1
 	github.com/gorilla/schema v1.2.0
@@ -25,6 +26,7 @@ require (
 	github.com/swaggo/http-swagger v1.1.2
 	github.com/swaggo/swag v1.7.3
 	github.com/xuri/excelize/v2 v2.4.1
+	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
 	golang.org/x/net v0.0.0-20211020060615-d418f374d309 // indirect
 	golang.org/x/sys v0.0.0-20211023085530-d6a326fbbf70 // indirect
 	golang.org/x/tools v0.1.7 // indirect
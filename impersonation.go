@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// superusers may act as another user to see exactly what that user sees,
+// either per request with the header or for the whole browser session with the cookie
+const (
+	impersonateHeader = "X-Impersonate-User"
+	impersonateCookie = "crutch_impersonate"
+)
+
+type Impersonator struct {
+	Id    int    `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+func impersonatedUserId(r *http.Request) (userId int, fromHeader bool, err error) {
+	value := r.Header.Get(impersonateHeader)
+	fromHeader = value != ""
+
+	if !fromHeader {
+		cookie, err := r.Cookie(impersonateCookie)
+		if err != nil || cookie.Value == "" {
+			return 0, false, nil
+		}
+		value = cookie.Value
+	}
+
+	userId, err = strconv.Atoi(value)
+	if err != nil || userId <= 0 {
+		return 0, fromHeader, fmt.Errorf("Invalid user id to impersonate: %s", value)
+	}
+
+	return userId, fromHeader, nil
+}
+
+// replaces authenticated user info with info of impersonated user, real user must be superuser
+// and it is checked on every request, so that revoking superuser rights stops impersonation immediately
+func (auth *AuthMiddleware) impersonate(w http.ResponseWriter, r *http.Request, ui *UserInfo) error {
+
+	userId, fromHeader, err := impersonatedUserId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+	if userId == 0 {
+		return nil
+	}
+
+	if !ui.Admin {
+		if !fromHeader {
+			// stale cookie should not lock user out
+			log.Warn("User ", ui.Id, " is not superuser, impersonation cookie is ignored")
+			return nil
+		}
+		err = fmt.Errorf("Impersonation requires superuser privileges")
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return err
+	}
+
+	target := &UserInfo{
+		Id:             userId,
+		AuthMethod:     ui.AuthMethod,
+		ApiLogin:       ui.ApiLogin,
+		Scopes:         ui.Scopes,
+		CompareList:    ui.CompareList,
+		ImpersonatedBy: &Impersonator{ui.Id, ui.Name, ui.Email},
+	}
+
+	// cache is keyed by session or API login of the real user, so it is not used here
+	err = auth.loadUserInfo(w, r, target, false)
+	if err != nil {
+		return err
+	}
+
+	log.Warn("User ", ui.Id, " (", ui.Email, ") acts as user ", target.Id, " (", target.Email, ") on ", r.URL.Path)
+	*ui = *target
+
+	return nil
+}
+
+type impersonationParams struct {
+	UserId int `json:"userId"`
+}
+
+// starts impersonation for browser session, every following request is served as for given user
+func (mh *MethodHandlers) startImpersonationHandler(w http.ResponseWriter, r *http.Request) error {
+
+	userInfo := mh.getUserInfo(r)
+
+	if !userInfo.Admin && userInfo.ImpersonatedBy == nil {
+		err := fmt.Errorf("This resource requires superuser privileges")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return err
+	}
+
+	var params impersonationParams
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		err = fmt.Errorf("Failed to decode impersonation params: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+
+	_, err = mh.prodDB.getUserInfo(params.UserId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     impersonateCookie,
+		Value:    strconv.Itoa(params.UserId),
+		Path:     "/",
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+func (mh *MethodHandlers) stopImpersonationHandler(w http.ResponseWriter, r *http.Request) error {
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     impersonateCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// keys of QWERTY layout and letters of ЙЦУКЕН on the same keys
+var qwertyToJcuken = map[rune]rune{
+	'`': 'ё', 'q': 'й', 'w': 'ц', 'e': 'у', 'r': 'к', 't': 'е', 'y': 'н', 'u': 'г', 'i': 'ш', 'o': 'щ', 'p': 'з', '[': 'х', ']': 'ъ',
+	'a': 'ф', 's': 'ы', 'd': 'в', 'f': 'а', 'g': 'п', 'h': 'р', 'j': 'о', 'k': 'л', 'l': 'д', ';': 'ж', '\'': 'э',
+	'z': 'я', 'x': 'ч', 'c': 'с', 'v': 'м', 'b': 'и', 'n': 'т', 'm': 'ь', ',': 'б', '.': 'ю',
+	'~': 'Ё', 'Q': 'Й', 'W': 'Ц', 'E': 'У', 'R': 'К', 'T': 'Е', 'Y': 'Н', 'U': 'Г', 'I': 'Ш', 'O': 'Щ', 'P': 'З', '{': 'Х', '}': 'Ъ',
+	'A': 'Ф', 'S': 'Ы', 'D': 'В', 'F': 'А', 'G': 'П', 'H': 'Р', 'J': 'О', 'K': 'Л', 'L': 'Д', ':': 'Ж', '"': 'Э',
+	'Z': 'Я', 'X': 'Ч', 'C': 'С', 'V': 'М', 'B': 'И', 'N': 'Т', 'M': 'Ь', '<': 'Б', '>': 'Ю',
+}
+
+var jcukenToQwerty = invertRunes(qwertyToJcuken)
+
+// Cyrillic to Latin, close to GOST 7.79-2000 system B without diacritics
+var cyrillicToLatin = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e", 'ж': "zh", 'з': "z", 'и': "i", 'й': "y",
+	'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f",
+	'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu", 'я': "ya",
+}
+
+// Latin to Cyrillic, longer combinations are matched first; "y" is handled separately
+var latinToCyrillic = []struct {
+	latin    string
+	cyrillic string
+}{
+	{"shch", "щ"}, {"sch", "щ"},
+	{"zh", "ж"}, {"kh", "х"}, {"ts", "ц"}, {"ch", "ч"}, {"sh", "ш"}, {"yu", "ю"}, {"ya", "я"}, {"yo", "ё"},
+	{"a", "а"}, {"b", "б"}, {"v", "в"}, {"g", "г"}, {"d", "д"}, {"e", "е"}, {"z", "з"}, {"i", "и"}, {"j", "й"},
+	{"k", "к"}, {"l", "л"}, {"m", "м"}, {"n", "н"}, {"o", "о"}, {"p", "п"}, {"r", "р"}, {"s", "с"}, {"t", "т"},
+	{"u", "у"}, {"f", "ф"}, {"h", "х"}, {"c", "ц"}, {"x", "кс"}, {"w", "в"}, {"q", "к"}, {"'", "ь"},
+}
+
+func invertRunes(m map[rune]rune) map[rune]rune {
+	inverted := make(map[rune]rune, len(m))
+	for k, v := range m {
+		inverted[v] = k
+	}
+	return inverted
+}
+
+// true if text has more Latin letters than Cyrillic ones
+func mostlyLatin(text string) bool {
+	latin, cyrillic := 0, 0
+	for _, r := range text {
+		if unicode.Is(unicode.Latin, r) {
+			latin++
+		} else if unicode.Is(unicode.Cyrillic, r) {
+			cyrillic++
+		}
+	}
+	return latin > cyrillic
+}
+
+func isLetter(runes []rune, i int) bool {
+	return i >= 0 && i < len(runes) && unicode.IsLetter(runes[i])
+}
+
+// text as if typed with the other keyboard layout, "ghjdjl" becomes "провод" and back;
+// only letters of the prevailing alphabet are converted, so "руддщ VDE" keeps VDE untouched,
+// punctuation keys are converted next to letters only, so that "1.5" stays as is
+func switchKeyboardLayout(text string) string {
+	latin := mostlyLatin(text)
+
+	runes := []rune(text)
+	var sb strings.Builder
+	for i, r := range runes {
+		if latin {
+			c, found := qwertyToJcuken[r]
+			if found && (unicode.IsLetter(r) || isLetter(runes, i-1) || isLetter(runes, i+1)) {
+				r = c
+			}
+		} else if c, found := jcukenToQwerty[r]; found {
+			r = c
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+func isUpper(runes []rune, i int) bool {
+	return i >= 0 && i < len(runes) && unicode.IsUpper(runes[i])
+}
+
+// transliterates text into the other alphabet, "shayba" becomes "шайба", "болт" becomes "bolt"
+func transliterate(text string) string {
+	if mostlyLatin(text) {
+		return transliterateLatin(text)
+	}
+
+	runes := []rune(text)
+	var sb strings.Builder
+	for i, r := range runes {
+		latin, found := cyrillicToLatin[unicode.ToLower(r)]
+		if !found {
+			sb.WriteRune(r)
+			continue
+		}
+		if unicode.IsUpper(r) {
+			// "Щит" gives "Shchit", "ЩИТ" gives "SHCHIT"
+			if isUpper(runes, i-1) || isUpper(runes, i+1) {
+				latin = strings.ToUpper(latin)
+			} else if latin != "" {
+				latin = strings.ToUpper(latin[:1]) + latin[1:]
+			}
+		}
+		sb.WriteString(latin)
+	}
+	return sb.String()
+}
+
+func isLatinVowel(r rune) bool {
+	return strings.ContainsRune("aeiou", unicode.ToLower(r))
+}
+
+func transliterateLatin(text string) string {
+	runes := []rune(text)
+	lower := []rune(strings.ToLower(text))
+
+	var sb strings.Builder
+	for i := 0; i < len(runes); {
+		cyrillic, size := "", 0
+
+		if lower[i] == 'y' && !strings.HasPrefix(string(lower[i:]), "yu") &&
+			!strings.HasPrefix(string(lower[i:]), "ya") && !strings.HasPrefix(string(lower[i:]), "yo") {
+			// "gayka" is "гайка", but "ryba" is "рыба"
+			cyrillic, size = "ы", 1
+			if i > 0 && isLatinVowel(runes[i-1]) {
+				cyrillic = "й"
+			}
+		} else {
+			for _, t := range latinToCyrillic {
+				if strings.HasPrefix(string(lower[i:]), t.latin) {
+					cyrillic, size = t.cyrillic, len([]rune(t.latin))
+					break
+				}
+			}
+		}
+
+		if size == 0 {
+			sb.WriteRune(runes[i])
+			i++
+			continue
+		}
+
+		if unicode.IsUpper(runes[i]) {
+			cyrillic = strings.ToUpper(cyrillic)
+		}
+		sb.WriteString(cyrillic)
+		i += size
+	}
+	return sb.String()
+}
+
+const (
+	correctionLayout          = "layout"
+	correctionTransliteration = "transliteration"
+	correctionSpelling        = "spelling"
+)
+
+type textAlternative struct {
+	Text       string
+	Correction string
+}
+
+// texts to retry search with when original text finds few products
+func textAlternatives(text string) []textAlternative {
+	alternatives := make([]textAlternative, 0, 2)
+	for _, alt := range []textAlternative{
+		{switchKeyboardLayout(text), correctionLayout},
+		{transliterate(text), correctionTransliteration},
+	} {
+		duplicate := strings.EqualFold(alt.Text, text)
+		for _, a := range alternatives {
+			duplicate = duplicate || strings.EqualFold(alt.Text, a.Text)
+		}
+		if !duplicate {
+			alternatives = append(alternatives, alt)
+		}
+	}
+	return alternatives
+}
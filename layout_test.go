@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"unicode"
+)
+
+func TestKeyboardLayout(t *testing.T) {
+	t.Run("Раскладки взаимно однозначны", func(t *testing.T) {
+		if len(jcukenToQwerty) != len(qwertyToJcuken) {
+			t.Fatalf("Layout has %d keys, inverted layout has %d", len(qwertyToJcuken), len(jcukenToQwerty))
+		}
+		for latin, cyrillic := range qwertyToJcuken {
+			if jcukenToQwerty[cyrillic] != latin {
+				t.Errorf("%c maps to %c, but %c maps back to %c", latin, cyrillic, cyrillic, jcukenToQwerty[cyrillic])
+			}
+			if !unicode.Is(unicode.Cyrillic, cyrillic) {
+				t.Errorf("%c maps to non Cyrillic %c", latin, cyrillic)
+			}
+			if unicode.IsLetter(latin) && unicode.IsUpper(latin) != unicode.IsUpper(cyrillic) {
+				t.Errorf("%c and %c differ in case", latin, cyrillic)
+			}
+		}
+	})
+
+	cases := []struct {
+		text     string
+		expected string
+	}{
+		{"ghjdjl", "провод"},
+		{"Ghjdjl", "Провод"},
+		{"ds,jh", "выбор"},
+		{"ikbajdfkmyfz vfibyf", "шлифовальная машина"},
+		{"RK>X", "КЛЮЧ"},
+		{"ukfpjr 12", "глазок 12"},
+		{"руддщ VDE", "hello VDE"},
+		{"ghjdjl 1.5 vv", "провод 1.5 мм"},
+		{"руддщ", "hello"},
+		{"Ыекщтп", "Strong"},
+		{"ьфшт 10", "main 10"},
+	}
+
+	for _, c := range cases {
+		if converted := switchKeyboardLayout(c.text); converted != c.expected {
+			t.Errorf("switchKeyboardLayout(%q) = %q instead of %q", c.text, converted, c.expected)
+		}
+	}
+}
+
+func TestTransliteration(t *testing.T) {
+	t.Run("Все буквы кириллицы транслитерируются", func(t *testing.T) {
+		for r := 'а'; r <= 'я'; r++ {
+			if _, found := cyrillicToLatin[r]; !found {
+				t.Errorf("No transliteration for %c", r)
+			}
+		}
+		if _, found := cyrillicToLatin['ё']; !found {
+			t.Errorf("No transliteration for ё")
+		}
+	})
+
+	t.Run("Все буквы латиницы транслитерируются", func(t *testing.T) {
+		for r := 'a'; r <= 'z'; r++ {
+			if transliterateLatin(string(r)) == string(r) {
+				t.Errorf("No transliteration for %c", r)
+			}
+		}
+	})
+
+	cases := []struct {
+		text     string
+		expected string
+	}{
+		{"shpil'ka", "шпилька"},
+		{"Shayba", "Шайба"},
+		{"gayka", "гайка"},
+		{"ryba", "рыба"},
+		{"zhilet", "жилет"},
+		{"shchit", "щит"},
+		{"yashchik", "ящик"},
+		{"SHAYBA M10", "ШАЙБА М10"},
+		{"болт", "bolt"},
+		{"Щит", "Shchit"},
+		{"ЩИТ", "SHCHIT"},
+		{"ВДА-ПЕ010", "VDA-PE010"},
+		{"подъёмник", "podemnik"},
+		{"хомут 20 мм", "khomut 20 mm"},
+	}
+
+	for _, c := range cases {
+		if converted := transliterate(c.text); converted != c.expected {
+			t.Errorf("transliterate(%q) = %q instead of %q", c.text, converted, c.expected)
+		}
+	}
+}
+
+func TestTextAlternatives(t *testing.T) {
+	alternatives := textAlternatives("ghjdjl")
+	if len(alternatives) != 2 || alternatives[0].Text != "провод" || alternatives[0].Correction != correctionLayout {
+		t.Errorf("Unexpected alternatives %v for ghjdjl", alternatives)
+	}
+
+	if alternatives := textAlternatives("123"); len(alternatives) != 0 {
+		t.Errorf("Text without letters must not have alternatives, got %v", alternatives)
+	}
+}
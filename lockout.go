@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// failed basic auth attempts are counted per API login and per client IP,
+// once counter reaches threshold the login (or IP) is locked with exponential backoff
+const (
+	loginFailuresThreshold = 5
+	ipFailuresThreshold    = 20
+	lockoutBase            = time.Minute
+	lockoutMax             = time.Hour
+	authFailureKindLogin   = "login"
+	authFailureKindIP      = "ip"
+)
+
+// used to spend the same time on unknown logins as on wrong passwords
+var dummyPasswordHash, _ = hashApiPassword(generatePassword(16, 2, 2, 2))
+
+type AuthLockout struct {
+	Id          int       `json:"id"`
+	Login       string    `json:"login"`
+	UserId      *int      `json:"userId"`
+	IP          string    `json:"ip"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"lockedUntil"`
+	DateCreated time.Time `json:"dateCreated"`
+}
+
+func lockoutDuration(failures int, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+
+	d := lockoutBase * time.Duration(math.Pow(2, float64(failures-threshold)))
+	if d > lockoutMax || d <= 0 {
+		d = lockoutMax
+	}
+	return d
+}
+
+// proxies allowed to report client address in X-Forwarded-For, set from TRUSTED_PROXIES
+var trustedProxies []*net.IPNet
+
+// failures are counted per client IP too, set from API_IP_LOCKOUT; behind reverse proxy without TRUSTED_PROXIES
+// every client has the address of proxy, and failures of one client would lock out all of them
+var ipLockout bool
+
+// parses CIDR or single address, which is treated as /32 (/128 for IPv6)
+func parseCIDR(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid IP address %s", s)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CIDR %s: %v", s, err)
+	}
+	return ipNet, nil
+}
+
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		ipNet, err := parseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// address of the client, X-Forwarded-For is taken into account only when request comes from trusted proxy;
+// the header is walked from the right, the first address not belonging to trusted proxies is the client
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !ipInNets(ip, trustedProxies) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		hopIP := net.ParseIP(hop)
+		if hopIP == nil {
+			break
+		}
+		host = hop
+		if !ipInNets(hopIP, trustedProxies) {
+			break
+		}
+	}
+
+	return host
+}
+
+func basicAuthFailed(w http.ResponseWriter, err error, status int, retryAfter time.Duration) error {
+	log.Error(err)
+	w.Header().Set("WWW-Authenticate", `Basic realm="Industrial.Market API"`)
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+	http.Error(w, err.Error(), status)
+	return err
+}
+
+func (auth *AuthMiddleware) registerBasicAuthFailure(ctx context.Context, login string, ip string, userId *int) {
+
+	lockedUntil := time.Time{}
+	failures := 0
+
+	type counter struct {
+		kind      string
+		key       string
+		threshold int
+	}
+	counters := []counter{{authFailureKindLogin, login, loginFailuresThreshold}}
+	if ipLockout {
+		counters = append(counters, counter{authFailureKindIP, ip, ipFailuresThreshold})
+	}
+
+	for _, f := range counters {
+		n, err := auth.crutchDB.registerAuthFailure(ctx, f.kind, f.key)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		if d := lockoutDuration(n, f.threshold); d > 0 {
+			until := time.Now().Add(d)
+			err = auth.crutchDB.setAuthLock(ctx, f.kind, f.key, until)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			if until.After(lockedUntil) {
+				lockedUntil = until
+				failures = n
+			}
+		}
+	}
+
+	if !lockedUntil.IsZero() {
+		log.Warn(fmt.Sprintf("API login %s from %s is locked until %v after %v failed attempts", login, ip, lockedUntil, failures))
+		err := auth.crutchDB.saveAuthLockout(ctx, login, userId, ip, failures, lockedUntil)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+}
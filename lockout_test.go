@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		list  []string
+		want  []string
+		valid bool
+	}{
+		{[]string{"10.0.0.0/8", " 192.168.1.0/24 "}, []string{"10.0.0.0/8", "192.168.1.0/24"}, true},
+		// single addresses are exact matches
+		{[]string{"203.0.113.7", "2001:db8::1"}, []string{"203.0.113.7/32", "2001:db8::1/128"}, true},
+		// host bits are dropped
+		{[]string{"192.168.1.10/24"}, []string{"192.168.1.0/24"}, true},
+		{[]string{"", "  ", "10.0.0.1"}, []string{"10.0.0.1/32"}, true},
+		{[]string{}, []string{}, true},
+		{[]string{"10.0.0.0/33"}, nil, false},
+		{[]string{"10.0.0.256"}, nil, false},
+		{[]string{"10.0.0.1", "example.com"}, nil, false},
+	}
+
+	for _, tt := range tests {
+		nets, err := parseCIDRs(tt.list)
+		if (err == nil) != tt.valid {
+			t.Errorf("parseCIDRs(%q) error = %v, want valid %v", tt.list, err, tt.valid)
+			continue
+		}
+		if !tt.valid {
+			continue
+		}
+		if len(nets) != len(tt.want) {
+			t.Errorf("parseCIDRs(%q) = %v, want %v", tt.list, nets, tt.want)
+			continue
+		}
+		for i, n := range nets {
+			if n.String() != tt.want[i] {
+				t.Errorf("parseCIDRs(%q)[%d] = %s, want %s", tt.list, i, n, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseCIDRs([]string{"10.0.0.0/8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved []*net.IPNet) { trustedProxies = saved }(trustedProxies)
+	trustedProxies = proxies
+
+	tests := []struct {
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"203.0.113.7:5000", nil, "203.0.113.7"},
+		// header of untrusted client is ignored
+		{"203.0.113.7:5000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"10.0.0.2:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		// client can prepend anything, the rightmost untrusted hop is the client
+		{"10.0.0.2:5000", []string{"1.2.3.4, 198.51.100.1, 10.0.0.3"}, "198.51.100.1"},
+		{"10.0.0.2:5000", []string{"1.2.3.4", "198.51.100.1, 10.0.0.3"}, "198.51.100.1"},
+		// only proxies in the chain, the farthest one is the client
+		{"10.0.0.2:5000", []string{"10.0.0.4, 10.0.0.3"}, "10.0.0.4"},
+		// walking stops at garbage
+		{"10.0.0.2:5000", []string{"198.51.100.1, unknown, 10.0.0.3"}, "10.0.0.3"},
+		{"10.0.0.2:5000", nil, "10.0.0.2"},
+		{"[2001:db8::5]:5000", []string{"2001:db9::1"}, "2001:db9::1"},
+		{"203.0.113.7", nil, "203.0.113.7"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		for _, f := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", f)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("clientIP(%s, %q) = %s, want %s", tt.remoteAddr, tt.forwarded, got, tt.want)
+		}
+	}
+}
+
+func TestLockoutDuration(t *testing.T) {
+	tests := []struct {
+		failures  int
+		threshold int
+		want      time.Duration
+	}{
+		{0, 5, 0},
+		{4, 5, 0},
+		{5, 5, time.Minute},
+		{6, 5, 2 * time.Minute},
+		{9, 5, 16 * time.Minute},
+		{10, 5, 32 * time.Minute},
+		// capped at lockoutMax
+		{11, 5, time.Hour},
+		{100, 5, time.Hour},
+		// overflow of shift is capped too
+		{5 + 64, 5, time.Hour},
+		{20, 20, time.Minute},
+		{19, 20, 0},
+	}
+
+	for _, tt := range tests {
+		if got := lockoutDuration(tt.failures, tt.threshold); got != tt.want {
+			t.Errorf("lockoutDuration(%d, %d) = %v, want %v", tt.failures, tt.threshold, got, tt.want)
+		}
+	}
+}
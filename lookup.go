@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// codes of one lookup request, all of them are matched in one multi search request
+const maxLookupItems = 500
+
+const (
+	lookupMatchExact = "exact"
+	lookupMatchFuzzy = "fuzzy"
+	lookupMatchNone  = "none"
+)
+
+// Cyrillic letters looking like Latin ones, codes typed in Cyrillic layout are matched with Latin ones
+var latinLookalikes = map[rune]rune{
+	'А': 'A', 'В': 'B', 'Е': 'E', 'К': 'K', 'М': 'M', 'Н': 'H', 'О': 'O', 'Р': 'P', 'С': 'C', 'Т': 'T', 'У': 'Y', 'Х': 'X',
+}
+
+// code in upper case without spaces and dashes, with Cyrillic look-alike letters replaced by Latin ones,
+// so that "vda-pe 010" and "VDА–РЕ010" with Cyrillic А, Р and Е are both "VDAPE010"
+func normalizeCode(code string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToUpper(code) {
+		if unicode.IsSpace(r) || unicode.Is(unicode.Pd, r) {
+			continue
+		}
+		if latin, found := latinLookalikes[r]; found {
+			r = latin
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+type LookupItem struct {
+	Code     string  `json:"code"`
+	Quantity float64 `json:"quantity"` // 1 when not set
+}
+
+type LookupParams struct {
+	Items  []LookupItem `json:"items"`
+	CityId int          `json:"cityId"`
+}
+
+type LookupResult struct {
+	Code     string             `json:"code"` // as requested
+	Quantity float64            `json:"quantity"`
+	Match    string             `json:"match"` // exact, fuzzy or none
+	Product  *SearchResultEntry `json:"product,omitempty"`
+	// rest of product in warehouses available to user covers quantity
+	Sufficient bool `json:"sufficient"`
+}
+
+type lookupHit struct {
+	Id    int
+	Exact bool
+}
+
+// best match for each normalized code among products available according to stock; exact match is
+// preferred by boost, fuzzy ones are found by edit distance of normalized code and of analyzed raw code
+func (es *ElasticHelper) lookupCodes(ctx context.Context, codes []string, raw map[string]string, stock *StockFilter) (map[string]lookupHit, error) {
+
+	hits := make(map[string]lookupHit)
+	if len(codes) == 0 {
+		return hits, nil
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, code := range codes {
+		q := map[string]interface{}{
+			"size":    1,
+			"_source": []string{"code"},
+			"query": map[string]interface{}{
+				"bool": map[string]interface{}{
+					"should": []interface{}{
+						map[string]interface{}{"term": map[string]interface{}{
+							"code_normalized": map[string]interface{}{"value": code, "boost": 10},
+						}},
+						map[string]interface{}{"fuzzy": map[string]interface{}{
+							"code_normalized": map[string]interface{}{"value": code, "fuzziness": "AUTO", "prefix_length": 1},
+						}},
+						map[string]interface{}{"match": map[string]interface{}{
+							"code": map[string]interface{}{"query": raw[code], "fuzziness": "AUTO", "operator": "and"},
+						}},
+					},
+					"minimum_should_match": 1,
+					"filter":               es.stockFilters(stock),
+				},
+			},
+		}
+		if err := encoder.Encode(map[string]interface{}{"index": productIndex}); err != nil {
+			return nil, fmt.Errorf("Error encoding query: %v", err)
+		}
+		if err := encoder.Encode(q); err != nil {
+			return nil, fmt.Errorf("Error encoding query: %v", err)
+		}
+	}
+
+	res, err := es.client.Msearch(
+		&buf,
+		es.client.Msearch.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting response: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("Lookup request failed: %s", res.Status())
+	}
+
+	var response struct {
+		Responses []map[string]interface{} `json:"responses"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("Error parsing elastic response: %v", err)
+	}
+
+	if len(response.Responses) != len(codes) {
+		return nil, fmt.Errorf("Elastic returned %d responses for %d lookup queries", len(response.Responses), len(codes))
+	}
+
+	for i, r := range response.Responses {
+		if r["error"] != nil {
+			return nil, fmt.Errorf("Lookup query failed: %v", r["error"])
+		}
+
+		found, _ := aggregation(r, "hits")["hits"].([]interface{})
+		if len(found) == 0 {
+			continue
+		}
+		h, _ := found[0].(map[string]interface{})
+		id, _ := strconv.Atoi(fmt.Sprint(h["_id"]))
+		code, _ := aggregation(h, "_source")["code"].(string)
+
+		hits[codes[i]] = lookupHit{id, normalizeCode(code) == codes[i]}
+	}
+
+	return hits, nil
+}
+
+// @Summary Look up products by codes
+// @Description Finds product for each code of the list, e.g. of bill of materials. Codes are compared without spaces and dashes, Cyrillic letters looking like Latin ones are treated as Latin. When there is no exact match, the closest code is returned with match "fuzzy".
+// @Tags products
+// @Accept  json
+// @Produce  json
+// @Param params body LookupParams true "Codes with optional quantities, up to 500"
+// @Success 200 {array} LookupResult
+// @Router /products/lookup [post]
+func (mh *MethodHandlers) lookupProductsHandler(w http.ResponseWriter, r *http.Request) error {
+
+	userInfo := mh.getUserInfo(r)
+
+	params := LookupParams{}
+
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		err = fmt.Errorf("Failed to decode request body - %s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+
+	results, err, code := mh.lookupProducts(r.Context(), userInfo, params)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(results)
+	if err != nil {
+		err = fmt.Errorf("Error while preparing json reponse: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	return nil
+}
+
+// results are in order of items, products come from prod DB with the same availability rules as search
+func (mh *MethodHandlers) lookupProducts(ctx context.Context, userInfo UserInfo, params LookupParams) (results []LookupResult, err error, code int) {
+
+	if len(params.Items) == 0 {
+		return nil, fmt.Errorf("No codes to look up"), http.StatusBadRequest
+	}
+	if len(params.Items) > maxLookupItems {
+		return nil, fmt.Errorf("Too many codes, up to %d can be looked up at once", maxLookupItems), http.StatusBadRequest
+	}
+
+	cities, err, code := mh.getSearchCities(ctx, userInfo)
+	if err != nil {
+		return nil, err, code
+	}
+
+	// the same code may be listed several times, it is looked up once
+	codes := make([]string, 0)
+	raw := make(map[string]string)
+	for _, item := range params.Items {
+		normalized := normalizeCode(item.Code)
+		if _, found := raw[normalized]; !found && normalized != "" {
+			codes = append(codes, normalized)
+			raw[normalized] = item.Code
+		}
+	}
+
+	stock := newStockFilter(userInfo, cities, &SearchQuery{CityID: params.CityId})
+	hits, err := mh.es.lookupCodes(ctx, codes, raw, stock)
+	if err != nil {
+		return nil, err, http.StatusInternalServerError
+	}
+
+	ids := make([]int, 0, len(hits))
+	for _, hit := range hits {
+		ids = append(ids, hit.Id)
+	}
+	entries, err := mh.prodDB.getProductEntries(ctx, ids, map[int]float64{}, userInfo, params.CityId, false, "", 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to retrieve list of products: %v", err), http.StatusInternalServerError
+	}
+	products := make(map[int]SearchResultEntry, len(entries))
+	for _, e := range entries {
+		products[e.Id] = e
+	}
+
+	results = make([]LookupResult, 0, len(params.Items))
+	found := 0
+	for _, item := range params.Items {
+		result := LookupResult{Code: item.Code, Quantity: item.Quantity, Match: lookupMatchNone}
+		if result.Quantity <= 0 {
+			result.Quantity = 1
+		}
+
+		if hit, ok := hits[normalizeCode(item.Code)]; ok {
+			if product, ok := products[hit.Id]; ok {
+				result.Product = &product
+				result.Match = lookupMatchFuzzy
+				if hit.Exact {
+					result.Match = lookupMatchExact
+				}
+				result.Sufficient = product.Rest >= result.Quantity
+				found++
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	log.Info("Lookup of ", len(params.Items), " codes by user ", userInfo.Id, ": ", found, " found")
+
+	return results, nil, http.StatusOK
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestNormalizeCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"VDA-PE010", "VDAPE010"},
+		{"vda pe 010", "VDAPE010"},
+		{" VDA–PE—010 ", "VDAPE010"},
+		{"VDА-РЕ010", "VDAPE010"}, // Cyrillic А, Р and Е
+		{"ркс-10", "PKC10"},
+		{"ГОСТ 7798-70", "ГOCT779870"}, // Г has no Latin look-alike
+		{"M10x1.5", "M10X1.5"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeCode(tt.code); got != tt.want {
+			t.Errorf("normalizeCode(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
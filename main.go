@@ -1,11 +1,14 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net/http"
 	"os"
 	"path"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -45,28 +48,43 @@ func getEnv(key string, defaultVal string) string {
 	return defaultVal
 }
 
-func initAuthMethodHandlers() (*MethodHandlers, *AuthMiddleware, error) {
-
-	elastic := getEnv("ELASTIC", "http://10.130.0.21:9400")
+func initElasticFromEnv() (*ElasticHelper, error) {
+	es, err := initElasticHelper(getEnv("ELASTIC", "http://10.130.0.21:9400"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to init Elastic connection: %v\n", err)
+	}
+	return es, nil
+}
 
+func initProdDBFromEnv() (*ProdDBHelper, error) {
 	prodDBHost := getEnv("PROD_DB_HOST", "10.130.0.13:5432")
 	prodDBUser := getEnv("PROD_DB_USER", "pguser")
 	prodDBPswd := getEnv("PROD_DB_PASSWORD", "pgpassword")
 	prodDBDtbs := getEnv("PROD_DB_DATABASE", "optima3_severstal")
 
+	prodDB, err := initProdDBHelper(prodDBHost, prodDBUser, prodDBPswd, prodDBDtbs)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to init DB connection: %v\n", err)
+	}
+	return prodDB, nil
+}
+
+func initAuthMethodHandlers() (*MethodHandlers, *AuthMiddleware, error) {
+
 	crutchDBHost := getEnv("CRUTCH_DB_HOST", "127.0.0.1:5432")
 	crutchDBUser := getEnv("CRUTCH_DB_USER", "pguser")
 	crutchDBPswd := getEnv("CRUTCH_DB_PASSWORD", "pgpassword")
 	crutchDBDtbs := getEnv("CRUTCH_DB_DATABASE", "crutch")
 
-	es, err := initElasticHelper(elastic)
+	es, err := initElasticFromEnv()
 	if err != nil {
-		return nil, nil, fmt.Errorf("Failed to init Elastic connection: %v\n", err)
+		return nil, nil, err
 	}
+	es.watchMapping()
 
-	prodDB, err := initProdDBHelper(prodDBHost, prodDBUser, prodDBPswd, prodDBDtbs)
+	prodDB, err := initProdDBFromEnv()
 	if err != nil {
-		return nil, nil, fmt.Errorf("Failed to init DB connection: %v\n", err)
+		return nil, nil, err
 	}
 
 	crutchDB, err := initCrutchDBHelper(crutchDBHost, crutchDBUser, crutchDBPswd, crutchDBDtbs)
@@ -74,8 +92,107 @@ func initAuthMethodHandlers() (*MethodHandlers, *AuthMiddleware, error) {
 		return nil, nil, fmt.Errorf("Failed to init DB connection: %v\n", err)
 	}
 
-	auth := initAuthMiddleware(prodDB, crutchDB)
-	methods := initMethodHandlers(es, prodDB, crutchDB)
+	tokens, err := initTokenConfig(getEnv("JWT_SECRET", ""), getEnv("JWT_TTL", "15m"), getEnv("JWT_REFRESH_TTL", "720h"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to init token config: %v\n", err)
+	}
+
+	// SECRET_KEY of Django app, fallback keys could be listed after comma; it is required unless
+	// DJANGO_SESSION_SIGNATURE_CHECK=false, then session data is trusted without signature as it was before
+	djangoSecretKeys := strings.Split(getEnv("DJANGO_SECRET_KEY", ""), ",")
+	sessionSignatureCheck, err := strconv.ParseBool(getEnv("DJANGO_SESSION_SIGNATURE_CHECK", "true"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse DJANGO_SESSION_SIGNATURE_CHECK: %v\n", err)
+	}
+	if !sessionSignatureCheck {
+		log.Warn("DJANGO_SESSION_SIGNATURE_CHECK is off, sessions are accepted without checking signature and password hash")
+		djangoSecretKeys = nil
+	} else if djangoSecretKeys[0] == "" {
+		return nil, nil, fmt.Errorf("DJANGO_SECRET_KEY is not set, it is required to validate sessions unless DJANGO_SESSION_SIGNATURE_CHECK=false\n")
+	}
+
+	userInfoCacheTTL, err := time.ParseDuration(getEnv("USER_INFO_CACHE_TTL", "1m"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse USER_INFO_CACHE_TTL: %v\n", err)
+	}
+	cache := initUserInfoCache(userInfoCacheTTL)
+
+	rps, err := strconv.ParseFloat(getEnv("API_RATE_LIMIT_RPS", "5"), 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse API_RATE_LIMIT_RPS: %v\n", err)
+	}
+	burst, err := strconv.Atoi(getEnv("API_RATE_LIMIT_BURST", "10"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse API_RATE_LIMIT_BURST: %v\n", err)
+	}
+	// 0 means there is no quota
+	dailyQuota, err := strconv.Atoi(getEnv("API_DAILY_QUOTA", "0"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse API_DAILY_QUOTA: %v\n", err)
+	}
+	monthlyQuota, err := strconv.Atoi(getEnv("API_MONTHLY_QUOTA", "0"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse API_MONTHLY_QUOTA: %v\n", err)
+	}
+	limiter, err := initRateLimiter(crutchDB, rps, burst, dailyQuota, monthlyQuota, getEnv("API_RATE_LIMIT_KEY", rateLimitByLogin))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to init rate limiter: %v\n", err)
+	}
+
+	auditRetentionDays, err := strconv.Atoi(getEnv("AUDIT_RETENTION_DAYS", "180"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse AUDIT_RETENTION_DAYS: %v\n", err)
+	}
+	audit := initAuditLog(crutchDB, time.Duration(auditRetentionDays)*24*time.Hour)
+
+	// JSON file mapping capabilities to Django permissions, groups and user flags
+	permissions, err := initPermissionResolver(getEnv("PERMISSIONS_CONFIG", ""))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to init permissions: %v\n", err)
+	}
+
+	// base64 encoded AES key used to encrypt signing secrets in crutch DB
+	signer, err := initRequestSigner(crutchDB, getEnv("SIGNING_KEY", ""), getEnv("SIGNATURE_MAX_SKEW", "5m"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to init request signing: %v\n", err)
+	}
+
+	// comma separated CIDRs of proxies which X-Forwarded-For is trusted from
+	trustedProxies, err = parseCIDRs(strings.Split(getEnv("TRUSTED_PROXIES", ""), ","))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse TRUSTED_PROXIES: %v\n", err)
+	}
+
+	// per-IP lockout is on by default only when client addresses are known, i.e. behind trusted proxies;
+	// service exposed directly may turn it on explicitly
+	ipLockout, err = strconv.ParseBool(getEnv("API_IP_LOCKOUT", strconv.FormatBool(len(trustedProxies) > 0)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse API_IP_LOCKOUT: %v\n", err)
+	}
+	if !ipLockout {
+		log.Warn("Failed API logins are not counted per client IP, set TRUSTED_PROXIES to enable it")
+	} else if len(trustedProxies) == 0 {
+		log.Warn("Failed API logins are counted per peer address, which is address of proxy if the service is behind one")
+	}
+
+	passwordGracePeriod, err := time.ParseDuration(getEnv("API_PASSWORD_GRACE_PERIOD", "72h"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse API_PASSWORD_GRACE_PERIOD: %v\n", err)
+	}
+
+	// consecutive ES failures after which search goes to prod DB, and for how long
+	searchBreakerFailures, err := strconv.Atoi(getEnv("SEARCH_BREAKER_FAILURES", "3"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse SEARCH_BREAKER_FAILURES: %v\n", err)
+	}
+	searchBreakerCooldown, err := time.ParseDuration(getEnv("SEARCH_BREAKER_COOLDOWN", "30s"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse SEARCH_BREAKER_COOLDOWN: %v\n", err)
+	}
+	search := initSearchBreaker(es, initPostgresSearch(prodDB), searchBreakerFailures, searchBreakerCooldown)
+
+	auth := initAuthMiddleware(prodDB, crutchDB, cache, tokens, djangoSecretKeys, limiter, audit, permissions, signer)
+	methods := initMethodHandlers(es, search, prodDB, crutchDB, cache, signer, passwordGracePeriod)
 
 	return methods, auth, nil
 }
@@ -90,6 +207,20 @@ func main() {
 		},
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "reindex" {
+		if err := runReindex(os.Args[2:]); err != nil {
+			log.Fatalf("Reindex failed: %v", err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "search-indexes" {
+		if err := runSearchIndexes(os.Args[2:]); err != nil {
+			log.Fatalf("Building search indexes failed: %v", err)
+		}
+		return
+	}
+
 	port := getEnv("PORT", "3001")
 	baseUrl := getEnv("BASEURL", "crutchdev")
 	docs.SwaggerInfo.BasePath = "/" + baseUrl + "/methods"
@@ -101,6 +232,14 @@ func main() {
 		log.Fatalf(err.Error())
 	}
 
+	// how often stock and visibility of products are copied to ES, 0 disables copying;
+	// set it on one instance only, each sync reads availability of the whole catalog from prod DB
+	availabilitySyncInterval, err := time.ParseDuration(getEnv("AVAILABILITY_SYNC_INTERVAL", "0"))
+	if err != nil {
+		log.Fatalf("Failed to parse AVAILABILITY_SYNC_INTERVAL: %v\n", err)
+	}
+	initAvailabilitySync(methods.es, methods.prodDB, availabilitySyncInterval)
+
 	router := mux.NewRouter().StrictSlash(true)
 	CSRF := csrf.Protect(
 		[]byte("dG3d563vyukewv%Yetrsbvsfd%WYfvs!"),
@@ -109,19 +248,43 @@ func main() {
 		csrf.HttpOnly(true),
 	)
 
+	tokenPath := "/" + baseUrl + "/methods/token"
+	router.Use(skipCSRFForApiClients(tokenPath))
 	router.Use(CSRF)
 
+	// token endpoint does its own authentication, so it goes before methods subrouter
+	router.Methods("POST").Path(tokenPath).Handler(appHandler(auth.tokenHandler))
+
 	crutchMethods := router.PathPrefix("/" + baseUrl + "/methods").Subrouter()
-	crutchMethods.Use(auth.authMiddleware)
-	crutchMethods.Methods("GET").Path("/counterparts").Handler(appHandler(methods.getCounterpartsHandler))
-	crutchMethods.Methods("GET").Path("/counterparts/excel").Handler(appHandler(methods.getCounterpartsExcelHandler))
-	crutchMethods.Methods("GET").Path("/products").Handler(appHandler(methods.searchProductsHandler))
-	crutchMethods.Methods("GET").Path("/orders").Handler(appHandler(methods.getOrdersHandler))
-	crutchMethods.Methods("GET").Path("/orders/excel").Handler(appHandler(methods.getOrdersExcelHandler))
-	crutchMethods.Methods("GET").Path("/orders/{orderId}").Handler(appHandler(methods.getOrderHandler))
-	crutchMethods.Methods("GET").Path("/currentUser").Handler(appHandler(methods.getCurrentUser))
-	crutchMethods.Methods("GET").Path("/apiCredentials").Handler(appHandler(methods.getApiCredentialsHandler))
-	crutchMethods.Methods("PUT").Path("/apiCredentials").Handler(appHandler(methods.putApiCredentialsHandler))
+	crutchMethods.Use(auth.authMiddleware, auth.audit.auditMiddleware, auth.limiter.rateLimitMiddleware)
+	crutchMethods.Methods("GET").Path("/counterparts").Handler(auth.require(capReadCounterparts, appHandler(methods.getCounterpartsHandler)))
+	crutchMethods.Methods("GET").Path("/counterparts/excel").Handler(auth.require(capReadCounterparts, appHandler(methods.getCounterpartsExcelHandler)))
+	crutchMethods.Methods("GET").Path("/products").Handler(auth.require(capSearchProducts, appHandler(methods.searchProductsHandler)))
+	crutchMethods.Methods("GET").Path("/products/suggest").Handler(auth.require(capSearchProducts, appHandler(methods.suggestProductsHandler)))
+	crutchMethods.Methods("POST").Path("/products/lookup").Handler(auth.require(capSearchProducts, appHandler(methods.lookupProductsHandler)))
+	crutchMethods.Methods("GET").Path("/orders").Handler(auth.require(capReadOrders, appHandler(methods.getOrdersHandler)))
+	crutchMethods.Methods("GET").Path("/orders/excel").Handler(auth.require(capExportOrders, appHandler(methods.getOrdersExcelHandler)))
+	crutchMethods.Methods("GET").Path("/orders/{orderId}").Handler(auth.require(capReadOrders, appHandler(methods.getOrderHandler)))
+	crutchMethods.Methods("GET").Path("/currentUser").Handler(auth.require(capUser, appHandler(methods.getCurrentUser)))
+	crutchMethods.Methods("GET").Path("/apiCredentials").Handler(auth.require(capManageCompany, appHandler(methods.getApiCredentialsHandler)))
+	crutchMethods.Methods("PUT").Path("/apiCredentials").Handler(auth.require(capManageCompany, appHandler(methods.putApiCredentialsHandler)))
+	crutchMethods.Methods("GET").Path("/apiCredentials/keys").Handler(auth.require(capManageCompany, appHandler(methods.getApiKeysHandler)))
+	crutchMethods.Methods("POST").Path("/apiCredentials/keys").Handler(auth.require(capManageCompany, appHandler(methods.createApiKeyHandler)))
+	crutchMethods.Methods("DELETE").Path("/apiCredentials/keys/{keyId}").Handler(auth.require(capManageCompany, appHandler(methods.revokeApiKeyHandler)))
+	crutchMethods.Methods("POST").Path("/apiCredentials/keys/{keyId}/signingSecret").Handler(auth.require(capManageCompany, appHandler(methods.createSigningSecretHandler)))
+	crutchMethods.Methods("GET").Path("/apiCredentials/certificates").Handler(auth.require(capManageCompany, appHandler(methods.getClientCertsHandler)))
+	crutchMethods.Methods("POST").Path("/apiCredentials/certificates").Handler(auth.require(capManageCompany, appHandler(methods.registerClientCertHandler)))
+	crutchMethods.Methods("DELETE").Path("/apiCredentials/certificates/{certId}").Handler(auth.require(capManageCompany, appHandler(methods.revokeClientCertHandler)))
+	crutchMethods.Methods("GET").Path("/serviceAccounts").Handler(auth.require(capManageCompany, appHandler(methods.getServiceAccountsHandler)))
+	crutchMethods.Methods("POST").Path("/serviceAccounts").Handler(auth.require(capManageCompany, appHandler(methods.createServiceAccountHandler)))
+	crutchMethods.Methods("PUT").Path("/serviceAccounts/{accountId}").Handler(auth.require(capManageCompany, appHandler(methods.updateServiceAccountHandler)))
+	crutchMethods.Methods("DELETE").Path("/serviceAccounts/{accountId}").Handler(auth.require(capManageCompany, appHandler(methods.revokeServiceAccountHandler)))
+	crutchMethods.Methods("GET").Path("/apiCredentials/lockouts").Handler(auth.require(capManageCompany, appHandler(methods.getAuthLockoutsHandler)))
+	crutchMethods.Methods("GET").Path("/apiUsage").Handler(auth.require(capManageCompany, appHandler(methods.getApiUsageHandler)))
+	crutchMethods.Methods("GET").Path("/auditLog").Handler(auth.require(capManageCompany, appHandler(methods.getAuditLogHandler)))
+	crutchMethods.Methods("POST").Path("/impersonation").Handler(auth.require(capUser, appHandler(methods.startImpersonationHandler)))
+	crutchMethods.Methods("DELETE").Path("/impersonation").Handler(auth.require(capUser, appHandler(methods.stopImpersonationHandler)))
+	crutchMethods.Methods("GET").Path("/metrics").Handler(auth.require(capAdmin, appHandler(methods.getMetricsHandler)))
 
 	crutch := router.PathPrefix("/" + baseUrl).Subrouter()
 
@@ -166,10 +329,12 @@ func main() {
 	crutch.PathPrefix("/").Handler(http.StripPrefix("/"+baseUrl, fsCrutch))
 
 	standinAPI := router.PathPrefix("/" + standinUrl + "/methods").Subrouter()
-	standinAPI.Use(auth.authMiddleware)
-	standinAPI.Methods("GET").Path("/current-user").Handler(appHandler(methods.getCurrentUserSI))
-	standinAPI.Methods("GET").Path("/cart-preview").Handler(appHandler(methods.getCartContent))
-	standinAPI.Methods("GET").Path("/products").Handler(appHandler(methods.searchProductsHandler))
+	standinAPI.Use(auth.authMiddleware, auth.audit.auditMiddleware, auth.limiter.rateLimitMiddleware)
+	standinAPI.Methods("GET").Path("/current-user").Handler(auth.require(capUser, appHandler(methods.getCurrentUserSI)))
+	standinAPI.Methods("GET").Path("/cart-preview").Handler(auth.require(capUser, appHandler(methods.getCartContent)))
+	standinAPI.Methods("GET").Path("/products").Handler(auth.require(capSearchProducts, appHandler(methods.searchProductsHandler)))
+	standinAPI.Methods("GET").Path("/products/suggest").Handler(auth.require(capSearchProducts, appHandler(methods.suggestProductsHandler)))
+	standinAPI.Methods("POST").Path("/products/lookup").Handler(auth.require(capSearchProducts, appHandler(methods.lookupProductsHandler)))
 
 	standin := router.PathPrefix("/" + standinUrl).Subrouter()
 	fsStandin := singlePageAppHandler(http.FileServer(http.Dir("./standin/dist")), "/"+standinUrl)
@@ -177,6 +342,34 @@ func main() {
 
 	http.Handle("/", WithLogging(router))
 
+	// built-in TLS listener, client certificates are requested and verified when CA bundle is set
+	tlsCert := getEnv("TLS_CERT", "")
+	tlsKey := getEnv("TLS_KEY", "")
+	if tlsCert != "" {
+		server := &http.Server{Addr: ":" + port, Handler: router}
+
+		if clientCA := getEnv("TLS_CLIENT_CA", ""); clientCA != "" {
+			caPEM, err := os.ReadFile(clientCA)
+			if err != nil {
+				log.Fatalf("Failed to read client CA bundle: %v", err)
+			}
+			caPool := x509.NewCertPool()
+			if !caPool.AppendCertsFromPEM(caPEM) {
+				log.Fatalf("No certificates found in client CA bundle %s", clientCA)
+			}
+			server.TLSConfig = &tls.Config{
+				ClientCAs:  caPool,
+				ClientAuth: tls.VerifyClientCertIfGiven,
+				MinVersion: tls.VersionTLS12,
+			}
+		}
+
+		log.Printf("Server listening on port %s (TLS), base url %s\n", port, baseUrl)
+		log.Panic(
+			server.ListenAndServeTLS(tlsCert, tlsKey),
+		)
+	}
+
 	log.Printf("Server listening on port %s, base url %s\n", port, baseUrl)
 	log.Panic(
 		http.ListenAndServe(":"+port, router),
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often mapping of product index is read again, it changes when reindex switches alias
+const mappingRefreshInterval = time.Minute
+
+// features of product index behind alias that queries depend on; indices mapped dynamically,
+// before conf/elastic/product_index.json, lack them until full reindex, and the parts of queries
+// which need them are left out instead of failing every search
+type productMapping struct {
+	NestedProperties bool // property facets and filters
+	SupplierKeyword  bool // supplier facet and filter
+	Shingles         bool // unstemmed shingles of name and description for spelling correction
+	// availability is nested and AvailabilitySync has filled it, search filters by stock in ES
+	StockSynced bool
+}
+
+type mappingState struct {
+	mu      sync.RWMutex
+	mapping productMapping
+	loaded  bool
+}
+
+// mapping of field by dotted path, sub-fields are looked up among fields of their parent
+func fieldMapping(mappings map[string]interface{}, path string) map[string]interface{} {
+	field := mappings
+	for _, name := range strings.Split(path, ".") {
+		next := aggregation(field, "properties", name)
+		if next == nil {
+			next = aggregation(field, "fields", name)
+		}
+		if next == nil {
+			return nil
+		}
+		field = next
+	}
+	return field
+}
+
+// alias may point to several indices, features have to be present in all of them
+func (es *ElasticHelper) getProductMapping(ctx context.Context) (productMapping, error) {
+	var indices map[string]struct {
+		Mappings map[string]interface{} `json:"mappings"`
+	}
+	err := es.perform(ctx, "GET", "/"+productIndex+"/_mapping", nil, &indices)
+	if err != nil {
+		return productMapping{}, err
+	}
+
+	found := len(indices) > 0
+	m := productMapping{NestedProperties: found, SupplierKeyword: found, Shingles: found, StockSynced: found}
+	for _, index := range indices {
+		m.StockSynced = m.StockSynced && aggregation(index.Mappings, "properties", "availability")["type"] == "nested" &&
+			aggregation(index.Mappings, "_meta")[availabilitySyncedMeta] == true
+		m.NestedProperties = m.NestedProperties && aggregation(index.Mappings, "properties", "properties")["type"] == "nested"
+		m.SupplierKeyword = m.SupplierKeyword && fieldMapping(index.Mappings, supplierFacetField) != nil
+		m.Shingles = m.Shingles && fieldMapping(index.Mappings, "name"+shingleSuffix) != nil &&
+			fieldMapping(index.Mappings, "description"+shingleSuffix) != nil
+	}
+	return m, nil
+}
+
+func (es *ElasticHelper) productMapping() productMapping {
+	es.mapping.mu.RLock()
+	defer es.mapping.mu.RUnlock()
+	return es.mapping.mapping
+}
+
+func (es *ElasticHelper) refreshMapping() {
+	m, err := es.getProductMapping(context.Background())
+	if err != nil {
+		log.Error("Failed to read mapping of product index: ", err)
+		return
+	}
+
+	es.mapping.mu.Lock()
+	changed := !es.mapping.loaded || m != es.mapping.mapping
+	es.mapping.mapping, es.mapping.loaded = m, true
+	es.mapping.mu.Unlock()
+
+	if changed {
+		log.Info("Product index mapping: ", m)
+		if !m.NestedProperties {
+			log.Warn("Properties are not nested in ", productIndex, ", property facets are off until full reindex")
+		}
+		if !m.SupplierKeyword {
+			log.Warn(supplierFacetField, " is not mapped in ", productIndex, ", supplier facet is off until full reindex")
+		}
+		if !m.Shingles {
+			log.Warn("Shingles are not mapped in ", productIndex, ", spelling is corrected by stems until full reindex")
+		}
+		if !m.StockSynced {
+			log.Warn("Availability is not synced into ", productIndex, ", search does not filter by stock in ES until it is")
+		}
+	}
+}
+
+// merges values into _meta of every index behind alias, PUT of _meta replaces it as a whole
+func (es *ElasticHelper) updateIndexMeta(ctx context.Context, alias string, values map[string]interface{}) error {
+	var indices map[string]struct {
+		Mappings struct {
+			Meta map[string]interface{} `json:"_meta"`
+		} `json:"mappings"`
+	}
+	err := es.perform(ctx, "GET", "/"+alias+"/_mapping", nil, &indices)
+	if err != nil {
+		return err
+	}
+
+	for index, mapping := range indices {
+		meta := mapping.Mappings.Meta
+		if meta == nil {
+			meta = make(map[string]interface{})
+		}
+		for k, v := range values {
+			meta[k] = v
+		}
+		err := es.perform(ctx, "PUT", "/"+index+"/_mapping", map[string]interface{}{"_meta": meta}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapping is read before the first search, then kept up to date in background
+func (es *ElasticHelper) watchMapping() {
+	es.refreshMapping()
+	go func() {
+		for range time.Tick(mappingRefreshInterval) {
+			es.refreshMapping()
+		}
+	}()
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 	"unicode/utf8"
 
 	"net/http"
@@ -22,14 +25,19 @@ import (
 const itemsPerPage = 200
 
 type MethodHandlers struct {
-	es       *ElasticHelper
-	prodDB   *ProdDBHelper
-	crutchDB *CrutchDBHelper
+	es        *ElasticHelper
+	search    searchBackend // ES behind circuit breaker with fallback to prod DB
+	prodDB    *ProdDBHelper
+	crutchDB  *CrutchDBHelper
+	userCache *UserInfoCache
+	signer    *requestSigner
+	// how long replaced password stays valid when rotated
+	passwordGracePeriod time.Duration
 }
 
-func initMethodHandlers(es *ElasticHelper, db *ProdDBHelper, crutchDb *CrutchDBHelper) *MethodHandlers {
+func initMethodHandlers(es *ElasticHelper, search searchBackend, db *ProdDBHelper, crutchDb *CrutchDBHelper, userCache *UserInfoCache, signer *requestSigner, passwordGracePeriod time.Duration) *MethodHandlers {
 
-	mh := MethodHandlers{es, db, crutchDb}
+	mh := MethodHandlers{es, search, db, crutchDb, userCache, signer, passwordGracePeriod}
 
 	return &mh
 }
@@ -44,13 +52,40 @@ type SearchResults struct {
 	Cities     []City              `json:"cities"`
 	Page       int                 `json:"page"`
 	TotalPages int                 `json:"totalPages"`
+	Cursor     string              `json:"cursor,omitempty"` // to request the page after Page
 	Results    []SearchResultEntry `json:"results"`
+	Facets     *Facets             `json:"facets,omitempty"`
+	// corrected text when original one finds few products, Corrected means results are found by it;
+	// Correction is either layout, transliteration or spelling
+	DidYouMean string `json:"didYouMean,omitempty"`
+	Correction string `json:"correction,omitempty"`
+	Corrected  bool   `json:"corrected,omitempty"`
+	// search backend which served the response, either elastic or postgres
+	Backend string `json:"backend"`
 }
 
 func (mh *MethodHandlers) getUserInfo(r *http.Request) UserInfo {
 	return gorilla_context.Get(r, "UserInfo").(UserInfo)
 }
 
+// @Summary Search products
+// @Description Full text search with multi-select facets. Pages are requested either by number within the first 10000 hits, or with cursor of the previous page which reaches the rest.
+// @Tags products
+// @Produce  json
+// @Param text query string false "Search text"
+// @Param page query int false "Page number" default(0)
+// @Param cursor query string false "Cursor of the previous page, page is ignored when it is set"
+// @Param cityId query int false "City to check stock in"
+// @Param inStock query bool false "Only products in stock"
+// @Param categories[] query []string false "Categories selected in facets"
+// @Param suppliers[] query []string false "Suppliers selected in facets"
+// @Param properties[] query []string false "Properties selected in facets, as name=value"
+// @Param priceMin query number false "Lower price bound without tax"
+// @Param priceMax query number false "Upper price bound without tax"
+// @Param sort query string false "Order of results" Enums(relevance, price_asc, price_desc, rest, name) default(relevance)
+// @Param noAutoCorrect query bool false "Do not search for corrected text when nothing is found"
+// @Success 200 {object} SearchResults
+// @Router /products [get]
 func (mh *MethodHandlers) searchProductsHandler(w http.ResponseWriter, r *http.Request) error {
 
 	userInfo := mh.getUserInfo(r)
@@ -88,59 +123,147 @@ func (mh *MethodHandlers) searchProducts(ctx context.Context, userInfo UserInfo,
 
 	log.Info(fmt.Printf("Handling search request text=%s, category=%s, code=%s, name=%s, property=%s, page=%v\n", searchQuery.Text, searchQuery.Category, searchQuery.Code, searchQuery.Name, searchQuery.Property, searchQuery.Page))
 
-	var cities []City
+	cities, err, status := mh.getSearchCities(ctx, userInfo)
+	if err != nil {
+		return nil, err, status
+	}
 
-	if !userInfo.Admin {
-		cities, err = mh.prodDB.getUserConsigneeCities(ctx, userInfo)
+	_, err = decodeCursor(&searchQuery)
+	if err != nil {
+		return nil, err, http.StatusBadRequest
+	}
+
+	err = searchQuery.checkPriceAndSort()
+	if err != nil {
+		return nil, err, http.StatusBadRequest
+	}
+
+	firstPage := searchQuery.Page == 0 && searchQuery.Cursor == ""
+
+	sr = &SearchResults{UserInfo: userInfo, Cities: cities}
+	err = mh.searchEntries(ctx, userInfo, searchQuery, sr)
+	if err == errCursorExpired {
+		return nil, err, http.StatusGone
+	}
+	if err != nil {
+		return nil, err, http.StatusInternalServerError
+	}
+
+	if !firstPage || len(sr.Results) >= fewSearchResults || strings.TrimSpace(searchQuery.Text) == "" {
+		return sr, nil, http.StatusOK
+	}
+
+	searchFor := func(alt textAlternative) (*SearchResults, error) {
+		altQuery := searchQuery
+		altQuery.Text = alt.Text
+		// most alternatives are discarded, the chosen one is paged by page numbers
+		altQuery.noCursor = true
+		altResults := &SearchResults{UserInfo: userInfo, Cities: cities, DidYouMean: alt.Text, Correction: alt.Correction}
+		return altResults, mh.searchEntries(ctx, userInfo, altQuery, altResults)
+	}
+
+	// text typed with wrong keyboard layout or transliterated is tried first, the one finding more is preferred
+	var best *SearchResults
+	for _, alt := range textAlternatives(searchQuery.Text) {
+		altResults, err := searchFor(alt)
 		if err != nil {
-			err = fmt.Errorf("Failed to get consignee cities: %s", err.Error())
-			return nil, err, http.StatusBadRequest
+			return nil, err, http.StatusInternalServerError
 		}
-
-		if len(cities) == 0 && userInfo.SupplierId != 0 {
-			cities, err = mh.prodDB.getSupplierCities(ctx, userInfo.SupplierId)
-			if err != nil {
-				return nil, err, http.StatusInternalServerError
-			}
+		if len(altResults.Results) > len(sr.Results) && (best == nil || len(altResults.Results) > len(best.Results)) {
+			best = altResults
 		}
+	}
 
-		if len(cities) == 0 {
-			err = fmt.Errorf("Current user does not have any warehouses assigned")
-			return nil, err, http.StatusBadRequest
+	if best == nil {
+		// misspelling is not a reason to fail the search, so errors of correction are only logged
+		corrected, err := mh.search.correctSpelling(searchQuery.Text, ctx)
+		if err != nil {
+			log.Error("Failed to correct spelling of '", searchQuery.Text, "': ", err)
+			return sr, nil, http.StatusOK
+		}
+		if corrected == "" {
+			return sr, nil, http.StatusOK
 		}
-	}
 
-	totalPages := 0
-	entries := make([]SearchResultEntry, 0)
-	tries := 0
-	for {
-		tries++
+		alt := textAlternative{corrected, correctionSpelling}
+		if len(sr.Results) > 0 || searchQuery.NoAutoCorrect {
+			sr.DidYouMean, sr.Correction = alt.Text, alt.Correction
+			return sr, nil, http.StatusOK
+		}
 
-		hits, totalPages_, err := mh.es.search(&searchQuery, ctx)
+		best, err = searchFor(alt)
 		if err != nil {
 			return nil, err, http.StatusInternalServerError
 		}
+	}
+
+	// results of corrected text are returned only instead of nothing, otherwise correction is just offered
+	if len(sr.Results) > 0 || len(best.Results) == 0 || searchQuery.NoAutoCorrect {
+		sr.DidYouMean, sr.Correction = best.DidYouMean, best.Correction
+		return sr, nil, http.StatusOK
+	}
+
+	log.Info("Nothing found for '", searchQuery.Text, "', returning results for '", best.DidYouMean, "' (", best.Correction, ")")
+	best.Corrected = true
+
+	return best, nil, http.StatusOK
+}
 
-		entries_, err := mh.getResponseEntries(ctx, hits, userInfo, searchQuery.CityID, searchQuery.InStockOnly, searchQuery.Supplier)
+// cities products are delivered to for customers, cities of warehouses for suppliers, none for admins
+func (mh *MethodHandlers) getSearchCities(ctx context.Context, userInfo UserInfo) (cities []City, err error, status int) {
+	if userInfo.Admin {
+		return nil, nil, http.StatusOK
+	}
+
+	if cities, found := mh.userCache.getCities(userInfo); found {
+		return cities, nil, http.StatusOK
+	}
+
+	cities, err = mh.prodDB.getUserConsigneeCities(ctx, userInfo)
+	if err != nil {
+		err = fmt.Errorf("Failed to get consignee cities: %s", err.Error())
+		return nil, err, http.StatusBadRequest
+	}
+
+	if len(cities) == 0 && userInfo.SupplierId != 0 {
+		cities, err = mh.prodDB.getSupplierCities(ctx, userInfo.SupplierId)
 		if err != nil {
 			return nil, err, http.StatusInternalServerError
 		}
+	}
 
-		entries = append(entries, entries_...)
-		totalPages = totalPages_
+	if len(cities) == 0 {
+		err = fmt.Errorf("Current user does not have any warehouses assigned")
+		return nil, err, http.StatusBadRequest
+	}
 
-		if len(entries) > itemsPerPage/10 || searchQuery.Page >= totalPages-1 {
-			break
-		}
-		searchQuery.Page++
+	mh.userCache.setCities(userInfo, cities)
+	return cities, nil, http.StatusOK
+}
+
+// one page of products available to user, availability is filtered by search backend and enriched from prod DB
+func (mh *MethodHandlers) searchEntries(ctx context.Context, userInfo UserInfo, searchQuery SearchQuery, sr *SearchResults) error {
+
+	page, err := mh.search.search(&searchQuery, newStockFilter(userInfo, sr.Cities, &searchQuery), ctx)
+	if err != nil {
+		return err
+	}
+
+	sr.Results, err = mh.getResponseEntries(ctx, page.Hits, userInfo, &searchQuery)
+	if err != nil {
+		return err
 	}
+	sr.Page, sr.TotalPages, sr.Cursor, sr.Facets, sr.Backend = page.Page, page.TotalPages, page.Cursor, page.Facets, page.Backend
 
-	log.Info("Have done ", tries, " queries to get ", len(entries), " product entries")
+	// prod DB still checks availability, so entries are lost only when index is behind it
+	if len(sr.Results) < len(page.Hits) {
+		log.Warn(len(page.Hits)-len(sr.Results), " of ", len(page.Hits), " products found in index are not available in prod DB")
+	}
 
-	return &SearchResults{userInfo, cities, searchQuery.Page, totalPages, entries}, nil, http.StatusOK
+	return nil
 }
 
-func (mh *MethodHandlers) getResponseEntries(ctx context.Context, hits []interface{}, userInfo UserInfo, cityId int, inStockOnly bool, supplier string) ([]SearchResultEntry, error) {
+func (mh *MethodHandlers) getResponseEntries(ctx context.Context, hits []interface{}, userInfo UserInfo, query *SearchQuery) ([]SearchResultEntry, error) {
 
 	ids := make([]int, len(hits))
 
@@ -156,7 +279,7 @@ func (mh *MethodHandlers) getResponseEntries(ctx context.Context, hits []interfa
 
 	log.Debug("Quering details for product_ids ", products_score)
 
-	products, err := mh.prodDB.getProductEntries(ctx, ids, products_score, userInfo, cityId, inStockOnly, supplier)
+	products, err := mh.prodDB.getProductEntries(ctx, ids, products_score, userInfo, query.CityID, query.InStockOnly, query.Supplier, query.PriceMin, query.PriceMax)
 
 	log.Debug("Got info for ", len(products), " entries")
 
@@ -259,12 +382,6 @@ func (mh *MethodHandlers) getCounterpartsHandler(w http.ResponseWriter, r *http.
 
 	userInfo := mh.getUserInfo(r)
 
-	if !userInfo.Admin && !userInfo.Staff {
-		log.Error("Insufficient privileges to get list of counterparts")
-		http.Error(w, "Inssuficient privileges", http.StatusUnauthorized)
-		return err
-	}
-
 	log.Info("Getting list of counterparts, filter ", filter)
 
 	counterparts, err := mh.prodDB.getCounterparts(r.Context(), userInfo, filter)
@@ -303,12 +420,6 @@ func (mh *MethodHandlers) getCounterpartsExcelHandler(w http.ResponseWriter, r *
 
 	userInfo := mh.getUserInfo(r)
 
-	if !userInfo.Admin && !userInfo.Staff {
-		log.Error("Insufficient privileges to get excel with list of counterparts")
-		http.Error(w, "This resource requires admin privileges", http.StatusUnauthorized)
-		return err
-	}
-
 	log.Info("Getting list of counterparts, filter ", filter)
 
 	counterparts, err := mh.prodDB.getCounterparts(r.Context(), userInfo, filter)
@@ -619,11 +730,6 @@ func (mh *MethodHandlers) getOrdersExcelHandler(w http.ResponseWriter, r *http.R
 
 func (mh *MethodHandlers) getOrdersExcel(ctx context.Context, userInfo UserInfo, ordersFilter OrdersFilter, fileName string) (err error, code int) {
 
-	if userInfo.SupplierId != 0 {
-		err := fmt.Errorf("This resource is not available for suppliers")
-		return err, http.StatusUnauthorized
-	}
-
 	ordersFilter.Page = 0
 	ordersFilter.ItemsPerPage = 0
 
@@ -888,10 +994,6 @@ func (mh *MethodHandlers) getCartContent(w http.ResponseWriter, r *http.Request)
 }
 
 func (mh *MethodHandlers) getApiCredentials(ctx context.Context, userInfo UserInfo) (ac *ApiCredentials, err error, code int) {
-	if !userInfo.CompanyAdmin && !userInfo.Admin {
-		return nil, fmt.Errorf("This resource requires company admin privileges"), http.StatusUnauthorized
-	}
-
 	apiCreds, err := mh.crutchDB.getApiCredentials(ctx, userInfo)
 
 	return apiCreds, err, http.StatusOK
@@ -924,13 +1026,29 @@ func (mh *MethodHandlers) getApiCredentialsHandler(w http.ResponseWriter, r *htt
 }
 
 type apiCredParams struct {
-	Enabled  *bool `json:"enabled"`
-	Password *bool `json:"password"`
+	Enabled       *bool     `json:"enabled"`
+	Password      *bool     `json:"password"`
+	Rotate        *bool     `json:"rotate"` // keep previous password valid for grace period
+	SigningSecret *bool     `json:"signingSecret"`
+	AllowedIPs    *[]string `json:"allowedIps"` // CIDRs or addresses, empty list removes restriction
 }
 
 func (mh *MethodHandlers) putApiCredentials(ctx context.Context, userInfo UserInfo, params apiCredParams) (apiCreds *ApiCredentials, err error, code int) {
-	if !userInfo.CompanyAdmin && !userInfo.Admin {
-		return nil, fmt.Errorf("This resource requires company admin privileges"), http.StatusUnauthorized
+	if params.AllowedIPs != nil {
+		nets, err := parseCIDRs(*params.AllowedIPs)
+		if err != nil {
+			return nil, err, http.StatusBadRequest
+		}
+
+		allowedIPs := make([]string, len(nets))
+		for i, n := range nets {
+			allowedIPs[i] = n.String()
+		}
+
+		apiCreds, err = mh.crutchDB.setApiCredentialsAllowedIPs(ctx, userInfo, allowedIPs)
+		if err != nil {
+			return nil, err, http.StatusInternalServerError
+		}
 	}
 
 	if params.Enabled != nil {
@@ -938,9 +1056,29 @@ func (mh *MethodHandlers) putApiCredentials(ctx context.Context, userInfo UserIn
 	}
 
 	if params.Password != nil {
-		apiCreds, err = mh.crutchDB.updateApiCredentialsPassword(ctx, userInfo)
+		var gracePeriod time.Duration
+		if params.Rotate != nil && *params.Rotate {
+			gracePeriod = mh.passwordGracePeriod
+		}
+		apiCreds, err = mh.crutchDB.updateApiCredentialsPassword(ctx, userInfo, gracePeriod)
+	}
+
+	if params.SigningSecret != nil && err == nil {
+		var secret string
+		_, secret, err, code = mh.createSigningSecret(ctx, userInfo, 0)
+		if err != nil {
+			return nil, err, code
+		}
+		if apiCreds == nil {
+			apiCreds, err = mh.crutchDB.getApiCredentials(ctx, userInfo)
+		}
+		if apiCreds != nil {
+			apiCreds.SigningSecret = secret
+		}
 	}
 
+	mh.userCache.invalidateUser(userInfo.Id)
+
 	if err != nil {
 		return nil, err, http.StatusInternalServerError
 	}
@@ -980,3 +1118,301 @@ func (mh *MethodHandlers) putApiCredentialsHandler(w http.ResponseWriter, r *htt
 
 	return nil
 }
+
+func (mh *MethodHandlers) getApiKeysHandler(w http.ResponseWriter, r *http.Request) error {
+
+	userInfo := mh.getUserInfo(r)
+
+	keys, err := mh.crutchDB.getApiKeys(r.Context(), userInfo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(struct {
+		Keys   []ApiKey `json:"keys"`
+		Scopes []string `json:"scopes"`
+	}{keys, apiScopes})
+
+	if err != nil {
+		err = fmt.Errorf("Error while preparing json reponse: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	return nil
+}
+
+type apiKeyParams struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+func (mh *MethodHandlers) createApiKey(ctx context.Context, userInfo UserInfo, params apiKeyParams) (key *ApiKey, err error, code int) {
+	if params.Name == "" || utf8.RuneCountInString(params.Name) > 64 || params.Name == defaultApiKeyName {
+		return nil, fmt.Errorf("API key name must be non empty string up to 64 characters, other than '%s'", defaultApiKeyName), http.StatusBadRequest
+	}
+
+	if len(params.Scopes) == 0 {
+		return nil, fmt.Errorf("At least one scope is required, available scopes are %v", apiScopes), http.StatusBadRequest
+	}
+	for _, scope := range params.Scopes {
+		if !contains(apiScopes, scope) {
+			return nil, fmt.Errorf("Unknown scope %s, available scopes are %v", scope, apiScopes), http.StatusBadRequest
+		}
+	}
+
+	if params.ExpiresAt != nil && params.ExpiresAt.Before(time.Now()) {
+		return nil, fmt.Errorf("Expiry date %v is in the past", params.ExpiresAt), http.StatusBadRequest
+	}
+
+	key, err = mh.crutchDB.createApiKey(ctx, userInfo, params.Name, params.Scopes, params.ExpiresAt)
+	if err != nil {
+		return nil, err, http.StatusInternalServerError
+	}
+
+	log.Info("User ", userInfo.Id, " created API key ", key.Login, " with scopes ", key.Scopes)
+
+	return key, nil, http.StatusCreated
+}
+
+func (mh *MethodHandlers) createApiKeyHandler(w http.ResponseWriter, r *http.Request) error {
+
+	userInfo := mh.getUserInfo(r)
+
+	params := apiKeyParams{}
+
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		err = fmt.Errorf("Failed to decode request body - %s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+
+	key, err, code := mh.createApiKey(r.Context(), userInfo, params)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	err = json.NewEncoder(w).Encode(key)
+
+	if err != nil {
+		err = fmt.Errorf("Error while preparing json reponse: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	return nil
+}
+
+func (mh *MethodHandlers) revokeApiKeyHandler(w http.ResponseWriter, r *http.Request) error {
+
+	userInfo := mh.getUserInfo(r)
+
+	keyId, err := strconv.Atoi(mux.Vars(r)["keyId"])
+	if err != nil {
+		err = fmt.Errorf("Failed to determine API key ID: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+
+	err = mh.crutchDB.revokeApiKey(r.Context(), userInfo, keyId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return err
+	}
+
+	mh.userCache.invalidateUser(userInfo.Id)
+
+	log.Info("User ", userInfo.Id, " revoked API key ", keyId)
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+// expvar counters, e.g. user info cache hits and misses
+func (mh *MethodHandlers) getMetricsHandler(w http.ResponseWriter, r *http.Request) error {
+
+	expvar.Handler().ServeHTTP(w, r)
+
+	return nil
+}
+
+// API logins of company users and service accounts locked after failed authentication attempts
+func (mh *MethodHandlers) getAuthLockoutsHandler(w http.ResponseWriter, r *http.Request) error {
+
+	userInfo := mh.getUserInfo(r)
+
+	var userIds []int
+	var contractorId, supplierId int
+	var err error
+	if !userInfo.Admin {
+		userIds, err = mh.prodDB.getCompanyUserIds(r.Context(), userInfo)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		contractorId, supplierId, err = serviceAccountCompany(userInfo)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return err
+		}
+	}
+
+	lockouts, err := mh.crutchDB.getAuthLockouts(r.Context(), userIds, contractorId, supplierId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(struct {
+		Lockouts []AuthLockout `json:"lockouts"`
+	}{lockouts})
+
+	if err != nil {
+		err = fmt.Errorf("Error while preparing json reponse: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	return nil
+}
+
+type ApiUsageFilter struct {
+	Start time.Time `schema:"start"`
+	End   time.Time `schema:"end"`
+}
+
+// API consumption of the company (or of all companies for admins)
+func (mh *MethodHandlers) getApiUsageHandler(w http.ResponseWriter, r *http.Request) error {
+
+	userInfo := mh.getUserInfo(r)
+
+	var filter ApiUsageFilter
+	decoder := schema.NewDecoder()
+	decoder.IgnoreUnknownKeys(true)
+	err := decoder.Decode(&filter, r.URL.Query())
+	if err != nil {
+		err = fmt.Errorf("Failed to decode filter: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+
+	if filter.End.IsZero() {
+		filter.End = time.Now()
+	}
+	if filter.Start.IsZero() {
+		filter.Start = filter.End.AddDate(0, 0, -30)
+	}
+
+	company := ""
+	if !userInfo.Admin {
+		company = companyKey(userInfo)
+	}
+
+	usage, err := mh.crutchDB.getApiUsage(r.Context(), company, filter.Start, filter.End)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(struct {
+		Usage []ApiUsage `json:"usage"`
+	}{usage})
+
+	if err != nil {
+		err = fmt.Errorf("Error while preparing json reponse: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	return nil
+}
+
+type AuditFilter struct {
+	Start        time.Time `schema:"start"`
+	End          time.Time `schema:"end"`
+	UserId       int       `schema:"userId"`
+	ContractorId int       `schema:"contractorId"`
+	SupplierId   int       `schema:"supplierId"`
+	ApiLogin     string    `schema:"apiLogin"`
+	Page         int       `schema:"page"`
+	ItemsPerPage int       `schema:"itemsPerPage"`
+}
+
+// API calls audit, company admins see only calls done by their company
+func (mh *MethodHandlers) getAuditLogHandler(w http.ResponseWriter, r *http.Request) error {
+
+	userInfo := mh.getUserInfo(r)
+
+	var filter AuditFilter
+	decoder := schema.NewDecoder()
+	decoder.IgnoreUnknownKeys(true)
+	err := decoder.Decode(&filter, r.URL.Query())
+	if err != nil {
+		err = fmt.Errorf("Failed to decode filter: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+
+	if !userInfo.Admin {
+		filter.ContractorId = 0
+		filter.SupplierId = userInfo.SupplierId
+		if userInfo.SupplierId == 0 {
+			filter.ContractorId = userInfo.ContractorId
+		}
+		// without company there is no condition to limit entries by
+		if filter.SupplierId == 0 && filter.ContractorId == 0 {
+			err = fmt.Errorf("Current user does not belong to any company")
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return err
+		}
+	}
+
+	if filter.Page < 0 {
+		err = fmt.Errorf("Page can not be negative")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+
+	if filter.ItemsPerPage <= 0 || filter.ItemsPerPage > 1000 {
+		filter.ItemsPerPage = 100
+	}
+
+	entries, err := mh.crutchDB.getAuditEntries(r.Context(), filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(struct {
+		Entries []AuditEntry `json:"entries"`
+	}{entries})
+
+	if err != nil {
+		err = fmt.Errorf("Error while preparing json reponse: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	return nil
+}
@@ -98,7 +98,7 @@ func TestAPI(t *testing.T) {
 			t.Errorf("Failed to update API credentials - %v", err)
 		}
 
-		if newCreds.Password != apiCreds.Password {
+		if newCreds.Password == "" || newCreds.Password == apiCreds.Password {
 			t.Errorf("Password was not updated")
 		}
 
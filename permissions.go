@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	gorilla_context "github.com/gorilla/context"
+)
+
+// named crutch capabilities, routes in main.go are protected with auth.require(capability)
+const (
+	capUser             = "user"
+	capSearchProducts   = "products.search"
+	capReadOrders       = "orders.read"
+	capReadAllOrders    = "orders.read_all"
+	capExportOrders     = "orders.export"
+	capReadCounterparts = "counterparts.read"
+	capReadBuyers       = "counterparts.read_buyers"
+	capReadSellers      = "counterparts.read_sellers"
+	capManageCompany    = "company.admin"
+	capAdmin            = "admin"
+)
+
+// capabilities available to API keys with limited scopes
+var scopeCapabilities = map[string][]string{
+	scopeOrdersRead:       {capReadOrders, capReadAllOrders, capExportOrders},
+	scopeProductsSearch:   {capSearchProducts},
+	scopeCounterpartsRead: {capReadCounterparts, capReadBuyers, capReadSellers},
+}
+
+// rule matches user if all conditions set in it hold, empty rule matches any user;
+// for lists it is enough to have one of listed permissions (groups)
+type PermissionRule struct {
+	Superuser    *bool `json:"superuser,omitempty"`
+	Staff        *bool `json:"staff,omitempty"`
+	CompanyAdmin *bool `json:"company_admin,omitempty"`
+	Supplier     *bool `json:"supplier,omitempty"`
+	// granted to user directly, permissions of groups are not counted
+	PermissionIds []int `json:"permission_ids,omitempty"`
+	// "app_label.codename", granted directly or through groups
+	Permissions []string `json:"permissions,omitempty"`
+	Groups      []string `json:"groups,omitempty"`
+}
+
+// capability is granted if any of its rules matches; superusers get only capabilities
+// with rules matching them, there is no implicit bypass
+type PermissionsConfig map[string][]PermissionRule
+
+func flag(b bool) *bool {
+	return &b
+}
+
+// reproduces permissions crutch had before they became configurable, e.g. orders export
+// stays closed to suppliers even if they are superusers
+var defaultPermissionsConfig = PermissionsConfig{
+	capUser:             {{}},
+	capSearchProducts:   {{}},
+	capReadOrders:       {{}},
+	capReadAllOrders:    {{Staff: flag(true), PermissionIds: []int{1067}}},
+	capExportOrders:     {{Supplier: flag(false)}},
+	capReadCounterparts: {{Staff: flag(true)}, {Superuser: flag(true)}},
+	capReadBuyers:       {{Staff: flag(true), PermissionIds: []int{286}}},
+	capReadSellers:      {{Staff: flag(true), PermissionIds: []int{678}}},
+	capManageCompany:    {{CompanyAdmin: flag(true)}, {Superuser: flag(true)}},
+	capAdmin:            {{Superuser: flag(true)}},
+}
+
+type PermissionResolver struct {
+	config PermissionsConfig
+}
+
+// loads config from JSON file, empty path means default config
+func initPermissionResolver(configPath string) (*PermissionResolver, error) {
+	if configPath == "" {
+		return &PermissionResolver{defaultPermissionsConfig}, nil
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read permissions config: %v", err)
+	}
+
+	config := PermissionsConfig{}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse permissions config: %v", err)
+	}
+
+	for _, capability := range []string{capUser, capAdmin} {
+		if _, found := config[capability]; !found {
+			config[capability] = defaultPermissionsConfig[capability]
+		}
+	}
+
+	return &PermissionResolver{config}, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func flagMatches(required *bool, value bool) bool {
+	return required == nil || *required == value
+}
+
+func (rule PermissionRule) matches(udi *UserDBInfo) bool {
+	if !flagMatches(rule.Superuser, udi.is_superuser) ||
+		!flagMatches(rule.Staff, udi.is_staff) ||
+		!flagMatches(rule.CompanyAdmin, udi.is_company_admin) ||
+		!flagMatches(rule.Supplier, udi.supplier_id != 0) {
+		return false
+	}
+
+	if len(rule.PermissionIds) > 0 {
+		found := false
+		for _, id := range rule.PermissionIds {
+			for _, userPermissionId := range udi.permission_ids {
+				found = found || id == userPermissionId
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(rule.Permissions) > 0 {
+		found := false
+		for _, p := range rule.Permissions {
+			found = found || contains(udi.permissions, p)
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(rule.Groups) > 0 {
+		found := false
+		for _, g := range rule.Groups {
+			found = found || contains(udi.groups, g)
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (pr *PermissionResolver) resolve(udi *UserDBInfo) []string {
+	capabilities := make([]string, 0)
+
+	for capability, rules := range pr.config {
+		granted := false
+		for _, rule := range rules {
+			granted = granted || rule.matches(udi)
+		}
+		if granted {
+			capabilities = append(capabilities, capability)
+		}
+	}
+
+	sort.Strings(capabilities)
+	return capabilities
+}
+
+// API keys with scopes get only capabilities listed in scopeCapabilities
+func (ui UserInfo) can(capability string) bool {
+	if !contains(ui.Capabilities, capability) {
+		return false
+	}
+
+	if ui.Scopes == nil {
+		return true
+	}
+
+	for _, scope := range ui.Scopes {
+		if contains(scopeCapabilities[scope], capability) {
+			return true
+		}
+	}
+	return false
+}
+
+func (auth *AuthMiddleware) require(capability string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		ui := gorilla_context.Get(r, "UserInfo").(UserInfo)
+		if ui.can(capability) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if ui.Scopes != nil && contains(ui.Capabilities, capability) {
+			err := fmt.Errorf("API key %s does not grant access to %s", ui.ApiLogin, r.URL.Path)
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		err := fmt.Errorf("This resource requires %s privileges", strings.ReplaceAll(capability, ".", " "))
+		log.Error("User ", ui.Id, ": ", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	})
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+// defaults must keep checks crutch had hard-coded before permissions became configurable
+func TestDefaultPermissions(t *testing.T) {
+	pr := PermissionResolver{defaultPermissionsConfig}
+
+	tests := []struct {
+		name    string
+		udi     UserDBInfo
+		granted []string
+		denied  []string
+	}{
+		{"superuser supplier", UserDBInfo{is_superuser: true, supplier_id: 1},
+			[]string{capAdmin, capManageCompany, capReadCounterparts}, []string{capExportOrders, capReadAllOrders}},
+		{"staff with direct permission", UserDBInfo{is_staff: true, permission_ids: []int{1067}},
+			[]string{capReadAllOrders, capReadCounterparts, capExportOrders}, []string{capAdmin, capManageCompany}},
+		{"staff with permission of group", UserDBInfo{is_staff: true, permissions: []string{"core.read_orders"}},
+			nil, []string{capReadAllOrders, capReadBuyers, capReadSellers}},
+		{"company admin", UserDBInfo{is_company_admin: true, contractor_id: 1},
+			[]string{capManageCompany, capExportOrders}, []string{capAdmin, capReadCounterparts}},
+	}
+
+	for _, tt := range tests {
+		capabilities := pr.resolve(&tt.udi)
+		for _, c := range tt.granted {
+			if !contains(capabilities, c) {
+				t.Errorf("%s: %s is not granted, got %v", tt.name, c, capabilities)
+			}
+		}
+		for _, c := range tt.denied {
+			if contains(capabilities, c) {
+				t.Errorf("%s: %s is granted", tt.name, c)
+			}
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"math"
 	"strconv"
@@ -62,15 +63,15 @@ type UserDBInfo struct {
 	is_superuser     bool
 	is_staff         bool
 	is_company_admin bool
-	can_read_orders  bool
-	can_read_buyers  bool
-	can_read_sellers bool
 	verified         bool
 	blocked          bool
 	contractor_id    int
 	contractor_name  string
 	supplier_id      int
 	supplier_name    string
+	permission_ids   []int // granted directly, not through groups
+	permissions      []string
+	groups           []string
 }
 
 func (db *ProdDBHelper) getUserInfo(userId int) (*UserDBInfo, error) {
@@ -82,9 +83,6 @@ func (db *ProdDBHelper) getUserInfo(userId int) (*UserDBInfo, error) {
 			is_superuser, 
 			is_staff,
 			company_admin,
-			COALESCE( can_read_orders, FALSE) can_read_orders,
-			COALESCE( can_read_buyers, FALSE) can_read_buyers,
-			COALESCE( can_read_sellers, FALSE) can_read_sellers,
 			verified, 
 			blocked,
 			COALESCE( current_contractor_id, 0),
@@ -93,16 +91,57 @@ func (db *ProdDBHelper) getUserInfo(userId int) (*UserDBInfo, error) {
 			COALESCE( sp.name, '')
 		FROM 
 			core_user cu 
-			LEFT JOIN (SELECT user_id, TRUE as can_read_orders FROM core_user_user_permissions up WHERE permission_id=1067) ro ON (ro.user_id=cu.id AND cu.is_staff) 
-			LEFT JOIN (SELECT user_id, TRUE as can_read_buyers FROM core_user_user_permissions up WHERE permission_id=286) rb ON (rb.user_id=cu.id AND cu.is_staff) 
-			LEFT JOIN (SELECT user_id, TRUE as can_read_sellers FROM core_user_user_permissions up WHERE permission_id=678) rs ON (rs.user_id=cu.id AND cu.is_staff) 
 			LEFT JOIN company_company cc ON (cc.object_id=cu.current_contractor_id AND cc.content_type_id=79)
 			LEFT JOIN company_company sp ON (sp.object_id=cu.supplier_id AND sp.content_type_id=186)
-		WHERE cu.id =$1`, userId).Scan(&ui.first_name, &ui.last_name, &ui.email, &ui.is_superuser, &ui.is_staff, &ui.is_company_admin, &ui.can_read_orders, &ui.can_read_buyers, &ui.can_read_sellers, &ui.verified, &ui.blocked, &ui.contractor_id, &ui.contractor_name, &ui.supplier_id, &ui.supplier_name)
+		WHERE cu.id =$1`, userId).Scan(&ui.first_name, &ui.last_name, &ui.email, &ui.is_superuser, &ui.is_staff, &ui.is_company_admin, &ui.verified, &ui.blocked, &ui.contractor_id, &ui.contractor_name, &ui.supplier_id, &ui.supplier_name)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to retrieve user info: %v", err)
 	}
 
+	// permissions granted directly and through groups, as Django ModelBackend does;
+	// ids are kept only for direct ones, hard-coded checks crutch had before looked at those
+	permissionRows, _ := db.pool.Query(context.Background(), `
+		SELECT p.id, ct.app_label || '.' || p.codename, 
+			p.id IN (SELECT permission_id FROM core_user_user_permissions WHERE user_id=$1) 
+		FROM auth_permission p 
+			JOIN django_content_type ct ON (ct.id = p.content_type_id) 
+		WHERE p.id IN (
+			SELECT permission_id FROM core_user_user_permissions WHERE user_id=$1 
+			UNION 
+			SELECT gp.permission_id FROM core_user_groups ug JOIN auth_group_permissions gp ON (gp.group_id = ug.group_id) WHERE ug.user_id=$1)`, userId)
+	defer permissionRows.Close()
+	for permissionRows.Next() {
+		var id int
+		var codename string
+		var direct bool
+		err = permissionRows.Scan(&id, &codename, &direct)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to retrieve user permissions: %v", err)
+		}
+		if direct {
+			ui.permission_ids = append(ui.permission_ids, id)
+		}
+		ui.permissions = append(ui.permissions, codename)
+	}
+	if permissionRows.Err() != nil {
+		return nil, fmt.Errorf("Failed to retrieve user permissions: %v", permissionRows.Err())
+	}
+
+	groupRows, _ := db.pool.Query(context.Background(), `
+		SELECT g.name FROM auth_group g JOIN core_user_groups ug ON (ug.group_id = g.id) WHERE ug.user_id=$1`, userId)
+	defer groupRows.Close()
+	for groupRows.Next() {
+		var group string
+		err = groupRows.Scan(&group)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to retrieve user groups: %v", err)
+		}
+		ui.groups = append(ui.groups, group)
+	}
+	if groupRows.Err() != nil {
+		return nil, fmt.Errorf("Failed to retrieve user groups: %v", groupRows.Err())
+	}
+
 	return &ui, nil
 
 }
@@ -113,6 +152,8 @@ func (db *ProdDBHelper) getUserConsigneeCities(ctx context.Context, userInfo Use
 
 	if userInfo.Admin {
 		rows, _ = db.pool.Query(ctx, "SELECT distinct id, city FROM company_city ORDER BY city")
+	} else if userInfo.ServiceAccount {
+		rows, _ = db.pool.Query(ctx, "SELECT distinct city_id, city FROM consignee_consignee con join company_city com on com.id = con.city_id where con.contractor_id=$1 ORDER BY city", userInfo.ContractorId)
 	} else {
 		rows, _ = db.pool.Query(ctx, "SELECT distinct city_id, city FROM core_user cu JOIN core_user_contractors cuc on cu.id = cuc.user_id join consignee_consignee con using(contractor_id) join company_city com on com.id = con.city_id where cuc.user_id=$1 ORDER BY city", userInfo.Id)
 	}
@@ -154,6 +195,46 @@ func (db *ProdDBHelper) getSupplierCities(ctx context.Context, supplierId int) (
 	return cities, rows.Err()
 }
 
+// users of the company current user belongs to (supplier or contractor)
+func (db *ProdDBHelper) getCompanyUserIds(ctx context.Context, userInfo UserInfo) (userIds []int, err error) {
+
+	var rows pgx.Rows
+
+	if userInfo.SupplierId != 0 {
+		rows, _ = db.pool.Query(ctx, "SELECT id FROM core_user WHERE supplier_id=$1", userInfo.SupplierId)
+	} else {
+		rows, _ = db.pool.Query(ctx, "SELECT DISTINCT user_id FROM core_user_contractors WHERE contractor_id=$1", userInfo.ContractorId)
+	}
+
+	userIds = make([]int, 0)
+	for rows.Next() {
+		var id int
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		userIds = append(userIds, id)
+	}
+
+	return userIds, rows.Err()
+}
+
+// name of contractor or supplier company
+func (db *ProdDBHelper) getCompanyName(ctx context.Context, contractorId int, supplierId int) (string, error) {
+	var name string
+	var err error
+	if supplierId != 0 {
+		err = db.pool.QueryRow(ctx, "SELECT name FROM company_company WHERE object_id=$1 AND content_type_id=186", supplierId).Scan(&name)
+	} else {
+		err = db.pool.QueryRow(ctx, "SELECT name FROM company_company WHERE object_id=$1 AND content_type_id=79", contractorId).Scan(&name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to retrieve company name: %v", err)
+	}
+
+	return name, nil
+}
+
 type SearchResultEntry struct {
 	Id             int     `json:"id"`
 	Category       string  `json:"category"`
@@ -169,7 +250,9 @@ type SearchResultEntry struct {
 	Score          float64 `json:"score"`
 }
 
-func (db *ProdDBHelper) getProductEntries(ctx context.Context, product_ids []int, products_score map[int]float64, userInfo UserInfo, city_id int, inStockOnly bool, supplier string) (products []SearchResultEntry, err error) {
+// entries keep order of product_ids, so that order of search backend is preserved;
+// price bounds are checked again, as price in index may be behind prod DB
+func (db *ProdDBHelper) getProductEntries(ctx context.Context, product_ids []int, products_score map[int]float64, userInfo UserInfo, city_id int, inStockOnly bool, supplier string, priceMin float64, priceMax float64) (products []SearchResultEntry, err error) {
 
 	args := []interface{}{product_ids}
 
@@ -194,13 +277,23 @@ func (db *ProdDBHelper) getProductEntries(ctx context.Context, product_ids []int
 			INNER JOIN supplier_warehouse_delivery_cities swc ON (sw.id = swc.warehouse_id) 
 		WHERE sw.is_visible = true  
 		`
-		args = append(args, userInfo.Id)
-		client_cities := `
-		SELECT DISTINCT city_id 
-		FROM core_user_contractors cuc 
-			JOIN consignee_consignee con USING(contractor_id) 
-			JOIN company_city com on com.id = con.city_id 
-		WHERE cuc.user_id=$` + strconv.Itoa(len(args))
+		var client_cities string
+		if userInfo.ServiceAccount {
+			args = append(args, userInfo.ContractorId)
+			client_cities = `
+			SELECT DISTINCT city_id 
+			FROM consignee_consignee con 
+				JOIN company_city com on com.id = con.city_id 
+			WHERE con.contractor_id=$` + strconv.Itoa(len(args))
+		} else {
+			args = append(args, userInfo.Id)
+			client_cities = `
+			SELECT DISTINCT city_id 
+			FROM core_user_contractors cuc 
+				JOIN consignee_consignee con USING(contractor_id) 
+				JOIN company_city com on com.id = con.city_id 
+			WHERE cuc.user_id=$` + strconv.Itoa(len(args))
+		}
 
 		supplier_warehouses += `	AND swc.city_id IN (` + client_cities + `)`
 
@@ -326,6 +419,15 @@ func (db *ProdDBHelper) getProductEntries(ctx context.Context, product_ids []int
 		query += " AND ss.make_orders_blocked=FALSE AND ss.work_blocked=FALSE"
 	}
 
+	if priceMin > 0 {
+		args = append(args, priceMin)
+		query += " AND NULLIF(pp.product_price, 0) >= $" + strconv.Itoa(len(args))
+	}
+	if priceMax > 0 {
+		args = append(args, priceMax)
+		query += " AND NULLIF(pp.product_price, 0) <= $" + strconv.Itoa(len(args))
+	}
+
 	query += " ORDER BY ordering"
 
 	rows, _ := db.pool.Query(ctx, query, args...)
@@ -378,6 +480,404 @@ func (db *ProdDBHelper) getProductEntries(ctx context.Context, product_ids []int
 	return products, rows.Err()
 }
 
+// search relevant state of products with id greater than afterId, ordered by id
+func (db *ProdDBHelper) getProductsAvailability(ctx context.Context, afterId int, limit int) (products []ProductAvailability, err error) {
+	return db.queryProductsAvailability(ctx, "pp.id > $1 ORDER BY pp.id LIMIT $2", afterId, limit)
+}
+
+// conditions are the same as in getProductEntries
+func (db *ProdDBHelper) queryProductsAvailability(ctx context.Context, where string, args ...interface{}) (products []ProductAvailability, err error) {
+
+	rows, _ := db.pool.Query(ctx, `
+	SELECT
+		pp.id,
+		(pp.deleted = false
+			AND pp.is_reference = false
+			AND pp.b_placement_state = 'placed'
+			AND pp.hidden = false
+			AND COALESCE(pc.hidden, false) = false
+			AND EXISTS (SELECT 1 FROM product_modification pm WHERE pm.product_id = pp.id AND pm.deleted = false)
+		) AS visible,
+		pp.category_id IS NOT NULL,
+		COALESCE(pp.enable_preorder, false),
+		NULLIF(pp.product_price, 0)::float8,
+		COALESCE(pp.supplier_id, 0),
+		COALESCE(cc.name, ''),
+		COALESCE(ss.make_orders_blocked OR ss.work_blocked, false),
+		COALESCE(w.availability, '[]')::text
+	FROM product_product pp
+		LEFT JOIN product_category pc ON (pp.category_id = pc.id)
+		LEFT JOIN company_company cc ON (cc.object_id = pp.supplier_id AND cc.content_type_id = 186)
+		LEFT JOIN supplier_supplier ss ON (ss.id = pp.supplier_id)
+		LEFT JOIN LATERAL (
+			SELECT json_agg(json_build_object('warehouse_id', r.warehouse_id, 'rest', r.rest, 'cities', r.cities)) AS availability
+			FROM (
+				SELECT
+					pr.warehouse_id,
+					SUM(pr.rest) AS rest,
+					(SELECT COALESCE(array_agg(swc.city_id), '{}') FROM supplier_warehouse_delivery_cities swc WHERE swc.warehouse_id = pr.warehouse_id) AS cities
+				FROM product_modification pm
+					JOIN product_rest pr ON (pm.id = pr.modification_id)
+					JOIN supplier_warehouse sw ON (sw.id = pr.warehouse_id AND sw.is_visible = true)
+				WHERE pm.product_id = pp.id AND pm.deleted = false
+				GROUP BY pr.warehouse_id
+			) r
+		) w ON true
+	WHERE `+where, args...)
+	defer rows.Close()
+
+	products = make([]ProductAvailability, 0)
+	for rows.Next() {
+		var p ProductAvailability
+		var availability string
+		err := rows.Scan(&p.Id, &p.Visible, &p.HasCategory, &p.EnablePreorder, &p.Price, &p.Supplier.Id, &p.Supplier.Name, &p.Supplier.Blocked, &availability)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal([]byte(availability), &p.Availability)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse availability of product %d: %v", p.Id, err)
+		}
+
+		products = append(products, p)
+	}
+
+	return products, rows.Err()
+}
+
+func (db *ProdDBHelper) hasExtension(ctx context.Context, name string) (bool, error) {
+	var found bool
+	err := db.pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = $1)`, name).Scan(&found)
+	return found, err
+}
+
+func (db *ProdDBHelper) hasColumn(ctx context.Context, table string, column string) (bool, error) {
+	var found bool
+	err := db.pool.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2)`,
+		table, column).Scan(&found)
+	return found, err
+}
+
+// text fallback search matches, the same expression is indexed by productSearchIndexes, columns are prefixed
+// with table alias in queries; it is immutable, unlike concat_ws, and covers columns of product_product only,
+// as expression index can not join
+func productSearchDocument(alias string) string {
+	return `to_tsvector('russian'::regconfig, COALESCE(` + alias + `code, '') || ' ' || COALESCE(` + alias + `name, '') || ' ' || COALESCE(` + alias + `description, ''))`
+}
+
+type searchIndex struct {
+	Name       string
+	Definition string
+}
+
+func (idx searchIndex) ddl() string {
+	return "CREATE INDEX CONCURRENTLY IF NOT EXISTS " + idx.Name + " " + idx.Definition
+}
+
+// indexes fallback search relies on, they are of no use to the main app and are built by `crutch search-indexes`;
+// trigram ones serve word_similarity on names and ILIKE on codes
+func productSearchIndexes(trigram bool) []searchIndex {
+	indexes := []searchIndex{
+		{"crutch_product_search_idx", `ON product_product USING gin ((` + productSearchDocument("") + `))`},
+	}
+	if trigram {
+		indexes = append(indexes,
+			searchIndex{"crutch_product_name_trgm_idx", `ON product_product USING gin (name gin_trgm_ops)`},
+			searchIndex{"crutch_product_code_trgm_idx", `ON product_product USING gin (code gin_trgm_ops)`},
+		)
+	}
+	return indexes
+}
+
+// names of indexes which do not exist or are left invalid by interrupted concurrent build
+func (db *ProdDBHelper) missingSearchIndexes(ctx context.Context, trigram bool) ([]string, error) {
+	names := make([]string, 0)
+	for _, idx := range productSearchIndexes(trigram) {
+		names = append(names, idx.Name)
+	}
+
+	rows, _ := db.pool.Query(ctx, `
+		SELECT c.relname 
+		FROM pg_class c 
+			JOIN pg_index i ON (i.indexrelid = c.oid) 
+		WHERE c.relname = ANY($1) AND i.indisvalid`, names)
+	defer rows.Close()
+
+	valid := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		valid = append(valid, name)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("Failed to check search indexes: %v", rows.Err())
+	}
+
+	missing := make([]string, 0)
+	for _, name := range names {
+		if !contains(valid, name) {
+			missing = append(missing, name)
+		}
+	}
+	return missing, nil
+}
+
+// indexes are built concurrently, so that product_product stays writable; invalid ones left by
+// interrupted build are dropped first, IF NOT EXISTS would keep them otherwise
+func (db *ProdDBHelper) createSearchIndexes(ctx context.Context, trigram bool) error {
+	missing, err := db.missingSearchIndexes(ctx, trigram)
+	if err != nil {
+		return err
+	}
+
+	for _, idx := range productSearchIndexes(trigram) {
+		if !contains(missing, idx.Name) {
+			log.Info("Search index ", idx.Name, " already exists")
+			continue
+		}
+
+		start := time.Now()
+		if _, err := db.pool.Exec(ctx, "DROP INDEX CONCURRENTLY IF EXISTS "+idx.Name); err != nil {
+			return fmt.Errorf("Failed to drop invalid search index %s: %v", idx.Name, err)
+		}
+		if _, err := db.pool.Exec(ctx, idx.ddl()); err != nil {
+			return fmt.Errorf("Failed to create search index %s: %v", idx.Name, err)
+		}
+		log.Info("Search index ", idx.Name, " is built, took ", time.Since(start))
+	}
+	return nil
+}
+
+// ids and ranks of products matching query for fallback search, ordered by rank; total is number of all matches.
+// Conditions follow StockFilter.filters and facetFilters, so that results are the same ES would find
+func (db *ProdDBHelper) searchProductIds(ctx context.Context, query *SearchQuery, stock *StockFilter, trigram bool, limit int, offset int) (ids []int, scores []float64, total int, err error) {
+
+	args := make([]interface{}, 0)
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	conditions := []string{`pp.deleted = false
+		AND pp.is_reference = false
+		AND pp.b_placement_state = 'placed'
+		AND pp.hidden = false
+		AND COALESCE(pc.hidden, false) = false
+		AND EXISTS (SELECT 1 FROM product_modification pm WHERE pm.product_id = pp.id AND pm.deleted = false)`}
+
+	rank := "0"
+	if text := strings.TrimSpace(query.Text); text != "" {
+		tsquery := `plainto_tsquery('russian'::regconfig, ` + arg(text) + `)`
+		document := productSearchDocument("pp.")
+		match := document + ` @@ ` + tsquery
+		rank = `ts_rank(` + document + `, ` + tsquery + `)`
+		// without trigram index code prefix would need sequential scan, codes are still matched as words
+		if trigram {
+			t := arg(text)
+			match += ` OR ` + t + ` <% pp.name OR pp.code ILIKE ` + arg(text+"%")
+			rank += ` + word_similarity(` + t + `, pp.name)`
+		}
+		conditions = append(conditions, "("+match+")")
+	}
+
+	if len(query.Category) > 2 {
+		conditions = append(conditions, `pc.name ILIKE `+arg("%"+query.Category+"%"))
+	}
+	if len(query.Code) > 2 {
+		conditions = append(conditions, `pp.code ILIKE `+arg("%"+query.Code+"%"))
+	}
+	if len(query.Name) > 2 {
+		conditions = append(conditions, `pp.name ILIKE `+arg("%"+query.Name+"%"))
+	}
+	if len(query.Property) > 2 {
+		conditions = append(conditions, `EXISTS (SELECT 1 FROM product_propertyvalue pv WHERE pv.product_id = pp.id AND pv.value ILIKE `+arg("%"+query.Property+"%")+`)`)
+	}
+
+	if len(query.Categories) > 0 {
+		conditions = append(conditions, `pc.name = ANY(`+arg(query.Categories)+`)`)
+	}
+	if len(query.Suppliers) > 0 {
+		conditions = append(conditions, `cc.name = ANY(`+arg(query.Suppliers)+`)`)
+	}
+	names, values := query.selectedProperties()
+	for _, name := range names {
+		conditions = append(conditions, `EXISTS (
+			SELECT 1 FROM product_propertyvalue pv
+				JOIN product_property ppr ON (ppr.id = pv.property_id)
+			WHERE pv.product_id = pp.id AND ppr.name = `+arg(name)+` AND pv.value = ANY(`+arg(values[name])+`))`)
+	}
+
+	if stock.Customer {
+		conditions = append(conditions, `pp.category_id IS NOT NULL`)
+	}
+
+	// rests of product in visible warehouses delivering to the cities
+	rests := func(inStock bool) string {
+		q := `FROM product_modification pm
+				JOIN product_rest pr ON (pm.id = pr.modification_id)
+				JOIN supplier_warehouse sw ON (sw.id = pr.warehouse_id AND sw.is_visible = true)
+			WHERE pm.product_id = pp.id AND pm.deleted = false`
+		if stock.Customer {
+			q += ` AND EXISTS (SELECT 1 FROM supplier_warehouse_delivery_cities swc WHERE swc.warehouse_id = pr.warehouse_id AND swc.city_id = ANY(` + arg(stock.Cities) + `))`
+		}
+		if stock.CityId > 0 {
+			q += ` AND EXISTS (SELECT 1 FROM supplier_warehouse_delivery_cities swc WHERE swc.warehouse_id = pr.warehouse_id AND swc.city_id = ` + arg(stock.CityId) + `)`
+		}
+		if inStock {
+			q += ` AND pr.rest > 0`
+		}
+		return q
+	}
+	warehouse := func(inStock bool) string {
+		return `EXISTS (SELECT 1 ` + rests(inStock) + `)`
+	}
+
+	switch {
+	case stock.InStockOnly:
+		conditions = append(conditions, warehouse(true))
+	case stock.Customer:
+		conditions = append(conditions, `(`+warehouse(true)+` OR (COALESCE(pp.enable_preorder, false) AND `+warehouse(false)+`))`)
+	case stock.CityId > 0:
+		conditions = append(conditions, warehouse(false))
+	}
+
+	if stock.SupplierId != 0 {
+		conditions = append(conditions, `pp.supplier_id = `+arg(stock.SupplierId))
+	} else {
+		conditions = append(conditions, `COALESCE(ss.make_orders_blocked OR ss.work_blocked, false) = false`)
+		if stock.Supplier != "" {
+			conditions = append(conditions, `cc.name ILIKE `+arg("%"+stock.Supplier+"%"))
+		}
+	}
+
+	if query.PriceMin > 0 {
+		conditions = append(conditions, `NULLIF(pp.product_price, 0) >= `+arg(query.PriceMin))
+	}
+	if query.PriceMax > 0 {
+		conditions = append(conditions, `NULLIF(pp.product_price, 0) <= `+arg(query.PriceMax))
+	}
+
+	// the same orders ES sorts by, see searchSort
+	order := `score DESC`
+	switch query.Sort {
+	case sortPriceAsc:
+		order = `NULLIF(pp.product_price, 0) ASC NULLS LAST, ` + order
+	case sortPriceDesc:
+		order = `NULLIF(pp.product_price, 0) DESC NULLS LAST, ` + order
+	case sortRest:
+		order = `(SELECT COALESCE(SUM(pr.rest), 0) ` + rests(false) + `) DESC, ` + order
+	case sortName:
+		order = `lower(pp.name), ` + order
+	}
+
+	rows, _ := db.pool.Query(ctx, `
+	SELECT pp.id, (`+rank+`)::float8 AS score, count(*) OVER ()
+	FROM product_product pp
+		LEFT JOIN product_category pc ON (pp.category_id = pc.id)
+		LEFT JOIN company_company cc ON (cc.object_id = pp.supplier_id AND cc.content_type_id = 186)
+		LEFT JOIN supplier_supplier ss ON (ss.id = pp.supplier_id)
+	WHERE `+strings.Join(conditions, `
+		AND `)+`
+	ORDER BY `+order+`, pp.id
+	LIMIT `+arg(limit)+` OFFSET `+arg(offset), args...)
+
+	ids = make([]int, 0)
+	scores = make([]float64, 0)
+	for rows.Next() {
+		var id int
+		var score float64
+		err := rows.Scan(&id, &score, &total)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		ids = append(ids, id)
+		scores = append(scores, score)
+	}
+
+	return ids, scores, total, rows.Err()
+}
+
+// column product modification time is tracked by, incremental reindex relies on it; product_product.date_modified
+// is auto_now field of Django model of the main app, runReindex checks that the column exists before loading
+const productModifiedColumn = "COALESCE(pp.date_modified, 'epoch'::timestamptz)"
+
+// products for search index with id greater than afterId modified after modifiedSince, ordered by id
+func (db *ProdDBHelper) getProductDocuments(ctx context.Context, afterId int, limit int, modifiedSince time.Time) (products []ProductDocument, err error) {
+
+	rows, _ := db.pool.Query(ctx, `
+	SELECT
+		pp.id,
+		COALESCE(pp.code, ''),
+		pp.name,
+		COALESCE(pp.description, ''),
+		`+productModifiedColumn+`,
+		COALESCE(pc.id, 0),
+		COALESCE(pc.name, ''),
+		COALESCE((
+			SELECT json_agg(json_build_object('property', json_build_object('id', ppr.id, 'name', ppr.name), 'value', pv.value))
+			FROM product_propertyvalue pv
+				JOIN product_property ppr ON (ppr.id = pv.property_id)
+			WHERE pv.product_id = pp.id AND pv.value > ''
+		), '[]')::text
+	FROM product_product pp
+		LEFT JOIN product_category pc ON (pp.category_id = pc.id)
+	WHERE pp.id > $1 AND `+productModifiedColumn+` > $3
+	ORDER BY pp.id
+	LIMIT $2`, afterId, limit, modifiedSince)
+	defer rows.Close()
+
+	products = make([]ProductDocument, 0)
+	ids := make([]int, 0)
+	for rows.Next() {
+		var p ProductDocument
+		var category ProductCategory
+		var properties string
+		err := rows.Scan(&p.Id, &p.Code, &p.Name, &p.Description, &p.DateModified, &category.Id, &category.Name, &properties)
+		if err != nil {
+			return nil, err
+		}
+
+		p.CodeNormalized = normalizeCode(p.Code)
+
+		p.Category = make([]ProductCategory, 0, 1)
+		if category.Id != 0 {
+			p.Category = append(p.Category, category)
+		}
+
+		err = json.Unmarshal([]byte(properties), &p.Properties)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse properties of product %d: %v", p.Id, err)
+		}
+
+		products = append(products, p)
+		ids = append(ids, p.Id)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	availability, err := db.queryProductsAvailability(ctx, "pp.id = ANY($1)", ids)
+	if err != nil {
+		return nil, err
+	}
+
+	byId := make(map[int]ProductAvailability, len(availability))
+	for _, a := range availability {
+		byId[a.Id] = a
+	}
+	for i := range products {
+		a := byId[products[i].Id]
+		a.Id = products[i].Id
+		products[i].ProductAvailability = a
+	}
+
+	return products, nil
+}
+
 func toString(v interface{}) string {
 	if v == nil {
 		return ""
@@ -619,6 +1119,12 @@ func (db *ProdDBHelper) ordersAccessRightsFilter(userInfo UserInfo) (string, []i
 			filterUsers = ` AND oo.supplier_id = $`
 			filterUsers += strconv.Itoa(len(args))
 			filterUsers += " AND oo.status_id NOT IN (18, 26, 23, 24, 26)"
+		} else if userInfo.ServiceAccount {
+
+			// service account is not a person, it sees orders of its company only
+			args = append(args, userInfo.ContractorId)
+			filterUsers = ` AND oo.contractor_id = $`
+			filterUsers += strconv.Itoa(len(args))
 		} else if userInfo.CompanyAdmin {
 
 			args = append(args, userInfo.Id)
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	gorilla_context "github.com/gorilla/context"
+)
+
+const (
+	rateLimitByLogin   = "login"
+	rateLimitByCompany = "company"
+	// how often requests counted in memory are added to crutch DB
+	usageFlushInterval = 10 * time.Second
+)
+
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// requests of one limit key in one day
+type usageCounter struct {
+	limitKey string
+	company  string
+	day      time.Time
+	daily    int // stored in crutch DB by all instances as of the last flush
+	monthly  int
+	pending  int // counted by this instance since the last flush
+}
+
+// throttles requests of API clients (sessions of UI users are not limited),
+// requests per second are limited in memory, daily and monthly quotas are counted in memory as well
+// and added to crutch DB every usageFlushInterval, so requests of other instances are seen with that delay
+type RateLimiter struct {
+	crutchDB     *CrutchDBHelper
+	rps          float64
+	burst        int
+	dailyQuota   int
+	monthlyQuota int
+	keyBy        string
+
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+
+	usageMutex sync.Mutex
+	usage      map[string]*usageCounter // by limit key and day
+}
+
+func initRateLimiter(crutchDB *CrutchDBHelper, rps float64, burst int, dailyQuota int, monthlyQuota int, keyBy string) (*RateLimiter, error) {
+	if keyBy != rateLimitByLogin && keyBy != rateLimitByCompany {
+		return nil, fmt.Errorf("Rate limit key must be either %s or %s", rateLimitByLogin, rateLimitByCompany)
+	}
+
+	if rps <= 0 {
+		return nil, fmt.Errorf("Rate limit must be positive number of requests per second, got %v", rps)
+	}
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	rl := RateLimiter{
+		crutchDB:     crutchDB,
+		rps:          rps,
+		burst:        burst,
+		dailyQuota:   dailyQuota,
+		monthlyQuota: monthlyQuota,
+		keyBy:        keyBy,
+		buckets:      make(map[string]*tokenBucket),
+		usage:        make(map[string]*usageCounter),
+	}
+
+	go func() {
+		for range time.Tick(10 * time.Minute) {
+			rl.removeIdleBuckets()
+		}
+	}()
+
+	go func() {
+		for range time.Tick(usageFlushInterval) {
+			rl.flushUsage(context.Background())
+		}
+	}()
+
+	return &rl, nil
+}
+
+func companyKey(ui UserInfo) string {
+	if ui.SupplierId != 0 {
+		return "supplier:" + strconv.Itoa(ui.SupplierId)
+	}
+	return "contractor:" + strconv.Itoa(ui.ContractorId)
+}
+
+func (rl *RateLimiter) limitKey(ui UserInfo) string {
+	if rl.keyBy == rateLimitByCompany {
+		return companyKey(ui)
+	}
+	return "login:" + ui.ApiLogin
+}
+
+// takes token from the bucket, returns tokens left and time to wait if bucket is empty
+func (rl *RateLimiter) take(key string) (remaining int, retryAfter time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := time.Now()
+	b, found := rl.buckets[key]
+	if !found {
+		b = &tokenBucket{tokens: float64(rl.burst), lastSeen: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(rl.burst), b.tokens+now.Sub(b.lastSeen).Seconds()*rl.rps)
+	b.lastSeen = now
+
+	if b.tokens < 1 {
+		return 0, time.Duration((1 - b.tokens) / rl.rps * float64(time.Second))
+	}
+
+	b.tokens--
+	return int(b.tokens), 0
+}
+
+func (rl *RateLimiter) removeIdleBuckets() {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	for key, b := range rl.buckets {
+		if time.Since(b.lastSeen) > 10*time.Minute {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+func today() time.Time {
+	now := time.Now()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+}
+
+// counts request unless it would exceed quota, returns requests of the day and of the month
+// with this one; counters are read from crutch DB once per key and day
+func (rl *RateLimiter) countRequest(ctx context.Context, key string, company string) (daily int, monthly int, exceeded bool, err error) {
+	day := today()
+	usageKey := key + "|" + day.Format("2006-01-02")
+
+	rl.usageMutex.Lock()
+	c, found := rl.usage[usageKey]
+	rl.usageMutex.Unlock()
+
+	if !found {
+		daily, monthly, err := rl.crutchDB.getApiRequests(ctx, key, day)
+		if err != nil {
+			return 0, 0, false, err
+		}
+
+		rl.usageMutex.Lock()
+		if c, found = rl.usage[usageKey]; !found {
+			c = &usageCounter{limitKey: key, company: company, day: day, daily: daily, monthly: monthly}
+			rl.usage[usageKey] = c
+		}
+		rl.usageMutex.Unlock()
+	}
+
+	rl.usageMutex.Lock()
+	defer rl.usageMutex.Unlock()
+
+	daily, monthly = c.daily+c.pending+1, c.monthly+c.pending+1
+	if (rl.monthlyQuota > 0 && monthly > rl.monthlyQuota) || (rl.dailyQuota > 0 && daily > rl.dailyQuota) {
+		// rejected requests are not counted, usage shows served ones only
+		return daily - 1, monthly - 1, true, nil
+	}
+
+	c.pending++
+	return daily, monthly, false, nil
+}
+
+// adds pending requests to crutch DB, counters of past days are dropped once they are stored
+func (rl *RateLimiter) flushUsage(ctx context.Context) {
+	day := today()
+	pending := make(map[*usageCounter]int)
+
+	rl.usageMutex.Lock()
+	for key, c := range rl.usage {
+		if c.pending > 0 {
+			pending[c] = c.pending
+		} else if c.day.Before(day) {
+			delete(rl.usage, key)
+		}
+	}
+	rl.usageMutex.Unlock()
+
+	for c, n := range pending {
+		daily, monthly, err := rl.crutchDB.addApiRequests(ctx, c.limitKey, c.company, c.day, n)
+		if err != nil {
+			// requests stay pending till the next flush
+			log.Error(err)
+			continue
+		}
+
+		rl.usageMutex.Lock()
+		c.daily, c.monthly = daily, monthly
+		c.pending -= n
+		rl.usageMutex.Unlock()
+	}
+}
+
+func setQuotaHeaders(w http.ResponseWriter, period string, quota int, used int, reset time.Time) {
+	if quota <= 0 {
+		return
+	}
+
+	remaining := quota - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	w.Header().Set("X-RateLimit-Limit-"+period, strconv.Itoa(quota))
+	w.Header().Set("X-RateLimit-Remaining-"+period, strconv.Itoa(remaining))
+	w.Header().Set("X-RateLimit-Reset-"+period, strconv.FormatInt(reset.Unix(), 10))
+}
+
+func (rl *RateLimiter) rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		ui := gorilla_context.Get(r, "UserInfo").(UserInfo)
+		if ui.ApiLogin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := rl.limitKey(ui)
+
+		remaining, retryAfter := rl.take(key)
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(rl.burst))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+
+		if retryAfter > 0 {
+			err := fmt.Errorf("Rate limit of %v requests per second is exceeded for %s", rl.rps, key)
+			log.Warn(err)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+
+		daily, monthly, exceeded, err := rl.countRequest(r.Context(), key, companyKey(ui))
+		if err != nil {
+			// failure to count request should not break API
+			log.Error(err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now()
+		nextDay := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+		nextMonth := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location())
+		setQuotaHeaders(w, "Day", rl.dailyQuota, daily, nextDay)
+		setQuotaHeaders(w, "Month", rl.monthlyQuota, monthly, nextMonth)
+
+		if exceeded {
+			reset := nextDay
+			if rl.monthlyQuota > 0 && monthly >= rl.monthlyQuota {
+				reset = nextMonth
+			}
+
+			err := fmt.Errorf("API quota is exhausted for %s until %v", key, reset.Format(time.RFC3339))
+			log.Warn(err)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(reset).Seconds()))))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestInitRateLimiterRejectsRps(t *testing.T) {
+	for _, rps := range []float64{0, -1} {
+		if _, err := initRateLimiter(nil, rps, 10, 0, 0, rateLimitByLogin); err == nil {
+			t.Errorf("Rate limit of %v requests per second is accepted", rps)
+		}
+	}
+}
+
+// counters are preloaded, so crutch DB is not needed
+func TestCountRequestQuota(t *testing.T) {
+	rl := RateLimiter{dailyQuota: 3, monthlyQuota: 10, usage: make(map[string]*usageCounter)}
+	day := today()
+	c := &usageCounter{limitKey: "login:erp", day: day, daily: 1, monthly: 8}
+	rl.usage["login:erp|"+day.Format("2006-01-02")] = c
+
+	daily, monthly, exceeded, err := rl.countRequest(context.Background(), "login:erp", "contractor:1")
+	if err != nil || exceeded || daily != 2 || monthly != 9 {
+		t.Errorf("First request: %d, %d, exceeded %v, %v", daily, monthly, exceeded, err)
+	}
+	daily, monthly, exceeded, _ = rl.countRequest(context.Background(), "login:erp", "contractor:1")
+	if exceeded || daily != 3 || monthly != 10 {
+		t.Errorf("Request up to quota: %d, %d, exceeded %v", daily, monthly, exceeded)
+	}
+
+	// monthly quota is reached too, rejected requests are not counted
+	for i := 0; i < 2; i++ {
+		daily, monthly, exceeded, _ = rl.countRequest(context.Background(), "login:erp", "contractor:1")
+		if !exceeded || daily != 3 || monthly != 10 {
+			t.Errorf("Request over quota: %d, %d, exceeded %v", daily, monthly, exceeded)
+		}
+	}
+	if c.pending != 2 {
+		t.Errorf("Got %d pending requests, want 2", c.pending)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	flagset "flag"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// settings and mapping of product index, versioned indices are created with them
+//
+//go:embed conf/elastic/product_index.json
+var productIndexSettings []byte
+
+// versioned indices are named productIndex_<timestamp>, search always goes through productIndex alias
+const productIndexVersionFormat = "20060102150405"
+
+// incremental reindex goes back that far from the last indexed modification, so that products saved in
+// transactions committed after the last run, but with earlier date_modified, are not missed
+const reindexSafetyWindow = 10 * time.Minute
+
+// `crutch reindex` builds new version of product index from prod DB and switches alias to it,
+// `crutch reindex -incremental` reindexes products modified since the last run into the current version
+func runReindex(args []string) error {
+	flags := flagset.NewFlagSet("reindex", flagset.ExitOnError)
+	incremental := flags.Bool("incremental", false, "reindex products modified since the last run into the index behind alias")
+	batchSize := flags.Int("batch", 1000, "number of products per bulk request")
+	dropLegacy := flags.Bool("drop-legacy", false, "delete concrete index named "+productIndex+" to put alias in its place")
+	keep := flags.Int("keep", 2, "number of versioned indices to keep, including the new one")
+	flags.Parse(args)
+
+	es, err := initElasticFromEnv()
+	if err != nil {
+		return err
+	}
+	prodDB, err := initProdDBFromEnv()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	found, err := prodDB.hasColumn(ctx, "product_product", "date_modified")
+	if err != nil {
+		return fmt.Errorf("Failed to check product_product.date_modified: %v", err)
+	}
+	if !found {
+		return fmt.Errorf("Column product_product.date_modified does not exist in prod DB, products can not be reindexed")
+	}
+
+	if *incremental {
+		return reindexIncremental(ctx, es, prodDB, *batchSize)
+	}
+	return reindexFull(ctx, es, prodDB, *batchSize, *dropLegacy, *keep)
+}
+
+// loads products modified after modifiedSince into index, returns the latest modification time seen
+func loadProducts(ctx context.Context, es *ElasticHelper, prodDB *ProdDBHelper, index string, batchSize int, modifiedSince time.Time) (time.Time, error) {
+	start := time.Now()
+	lastModified := modifiedSince
+	total, failedTotal := 0, 0
+
+	for afterId := 0; ; {
+		batch, err := prodDB.getProductDocuments(ctx, afterId, batchSize, modifiedSince)
+		if err != nil {
+			return lastModified, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		afterId = batch[len(batch)-1].Id
+
+		docs := make([]bulkDoc, 0, len(batch))
+		for _, p := range batch {
+			docs = append(docs, bulkDoc{p.Id, p})
+			if p.DateModified.After(lastModified) {
+				lastModified = p.DateModified
+			}
+		}
+
+		failed, _, err := es.bulk(ctx, index, "index", docs)
+		if err != nil {
+			return lastModified, err
+		}
+		total += len(docs)
+		failedTotal += len(failed)
+		log.Info("Reindex: ", total, " products loaded into ", index)
+	}
+
+	if failedTotal > 0 {
+		return lastModified, fmt.Errorf("Failed to index %d of %d products", failedTotal, total)
+	}
+
+	log.Info("Reindex: loaded ", total, " products into ", index, ", took ", time.Since(start))
+	return lastModified, nil
+}
+
+// modification time of the last indexed product is kept in _meta of index mapping
+func setLastModified(ctx context.Context, es *ElasticHelper, index string, lastModified time.Time) error {
+	return es.updateIndexMeta(ctx, index, map[string]interface{}{"last_modified": lastModified.Format(time.RFC3339Nano)})
+}
+
+func getLastModified(ctx context.Context, es *ElasticHelper, index string) (time.Time, error) {
+	var mappings map[string]struct {
+		Mappings struct {
+			Meta struct {
+				LastModified string `json:"last_modified"`
+			} `json:"_meta"`
+		} `json:"mappings"`
+	}
+	err := es.perform(ctx, "GET", "/"+index+"/_mapping", nil, &mappings)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	lastModified := mappings[index].Mappings.Meta.LastModified
+	if lastModified == "" {
+		return time.Time{}, fmt.Errorf("Index %s has no modification time of last reindex, full reindex is required", index)
+	}
+	return time.Parse(time.RFC3339Nano, lastModified)
+}
+
+// concrete indices whose names start with prefix
+func listIndices(ctx context.Context, es *ElasticHelper, prefix string) ([]string, error) {
+	var indices []struct {
+		Index string `json:"index"`
+	}
+	err := es.perform(ctx, "GET", "/_cat/indices/"+prefix+"*?format=json&h=index", nil, &indices)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(indices))
+	for _, i := range indices {
+		names = append(names, i.Index)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// indices the alias points to, empty if there is no such alias
+func aliasIndices(ctx context.Context, es *ElasticHelper, alias string) ([]string, error) {
+	var aliases []struct {
+		Index string `json:"index"`
+	}
+	err := es.perform(ctx, "GET", "/_cat/aliases/"+alias+"?format=json&h=index", nil, &aliases)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(aliases))
+	for _, a := range aliases {
+		names = append(names, a.Index)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func reindexFull(ctx context.Context, es *ElasticHelper, prodDB *ProdDBHelper, batchSize int, dropLegacy bool, keep int) error {
+	existing, err := listIndices(ctx, es, productIndex)
+	if err != nil {
+		return fmt.Errorf("Failed to list indices: %v", err)
+	}
+	legacy := contains(existing, productIndex)
+	if legacy && !dropLegacy {
+		return fmt.Errorf("%s is a concrete index, not an alias; run with -drop-legacy to replace it", productIndex)
+	}
+
+	index := productIndex + "_" + time.Now().Format(productIndexVersionFormat)
+
+	var settings interface{}
+	if err := json.Unmarshal(productIndexSettings, &settings); err != nil {
+		return fmt.Errorf("Failed to parse product index settings: %v", err)
+	}
+	if err := es.perform(ctx, "PUT", "/"+index, settings, nil); err != nil {
+		return fmt.Errorf("Failed to create index: %v", err)
+	}
+	log.Info("Reindex: created index ", index)
+
+	lastModified, err := loadProducts(ctx, es, prodDB, index, batchSize, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	if err := es.perform(ctx, "POST", "/"+index+"/_refresh", nil, nil); err != nil {
+		return fmt.Errorf("Failed to refresh index: %v", err)
+	}
+	if err := setLastModified(ctx, es, index, lastModified); err != nil {
+		return fmt.Errorf("Failed to save modification time: %v", err)
+	}
+
+	// alias is moved in one request, so searches never see missing or half-loaded index
+	current, err := aliasIndices(ctx, es, productIndex)
+	if err != nil {
+		return fmt.Errorf("Failed to get alias: %v", err)
+	}
+	actions := make([]interface{}, 0)
+	for _, old := range current {
+		actions = append(actions, map[string]interface{}{
+			"remove": map[string]interface{}{"index": old, "alias": productIndex},
+		})
+	}
+	if legacy {
+		actions = append(actions, map[string]interface{}{
+			"remove_index": map[string]interface{}{"index": productIndex},
+		})
+	}
+	actions = append(actions, map[string]interface{}{
+		"add": map[string]interface{}{"index": index, "alias": productIndex},
+	})
+	err = es.perform(ctx, "POST", "/_aliases", map[string]interface{}{"actions": actions}, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to switch alias: %v", err)
+	}
+	log.Info("Reindex: alias ", productIndex, " switched to ", index)
+
+	// older versions are kept for rollback, newest first
+	versions, err := listIndices(ctx, es, productIndex+"_")
+	if err != nil {
+		return fmt.Errorf("Failed to list indices: %v", err)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(versions)))
+	for i, old := range versions {
+		if i < keep || old == index {
+			continue
+		}
+		if err := es.perform(ctx, "DELETE", "/"+old, nil, nil); err != nil {
+			log.Error("Failed to delete old index ", old, ": ", err)
+			continue
+		}
+		log.Info("Reindex: deleted old index ", old)
+	}
+
+	// availability could change while products were loading
+	as := AvailabilitySync{es, prodDB, make(map[int]uint64)}
+	return as.sync(ctx)
+}
+
+func reindexIncremental(ctx context.Context, es *ElasticHelper, prodDB *ProdDBHelper, batchSize int) error {
+	current, err := aliasIndices(ctx, es, productIndex)
+	if err != nil {
+		return fmt.Errorf("Failed to get alias: %v", err)
+	}
+	if len(current) != 1 {
+		return fmt.Errorf("Alias %s points to %d indices, full reindex is required", productIndex, len(current))
+	}
+	index := current[0]
+
+	lastIndexed, err := getLastModified(ctx, es, index)
+	if err != nil {
+		return fmt.Errorf("Failed to get modification time of last reindex: %v", err)
+	}
+	// products reindexed twice are just overwritten
+	modifiedSince := lastIndexed.Add(-reindexSafetyWindow)
+	log.Info("Reindex: loading products modified after ", modifiedSince, " into ", index)
+
+	lastModified, err := loadProducts(ctx, es, prodDB, index, batchSize, modifiedSince)
+	if err != nil {
+		return err
+	}
+
+	// window must not move watermark back when nothing new was modified
+	if lastModified.Before(lastIndexed) {
+		lastModified = lastIndexed
+	}
+	if err := setLastModified(ctx, es, index, lastModified); err != nil {
+		return fmt.Errorf("Failed to save modification time: %v", err)
+	}
+	return nil
+}
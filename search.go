@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	flagset "flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	searchBackendElastic  = "elastic"
+	searchBackendPostgres = "postgres"
+)
+
+// responses served by each search backend
+var searchBackendResponses = expvar.NewMap("search_backend_responses")
+
+// finds products matching query among ones available according to stock, one page at a time;
+// hits are in ES format, maps with _id and _score, as getResponseEntries expects them
+type searchBackend interface {
+	name() string
+	search(query *SearchQuery, stock *StockFilter, ctx context.Context) (*SearchPage, error)
+	correctSpelling(text string, ctx context.Context) (string, error)
+}
+
+func (es *ElasticHelper) name() string {
+	return searchBackendElastic
+}
+
+// full-text search in prod DB, used when ES is unavailable; it neither counts facets nor issues cursors,
+// products are matched by tsvector and, when pg_trgm is installed, by trigram similarity of names
+type postgresSearch struct {
+	db      *ProdDBHelper
+	trigram bool
+}
+
+func initPostgresSearch(db *ProdDBHelper) *postgresSearch {
+	ps := postgresSearch{db: db}
+
+	var err error
+	ps.trigram, err = db.hasExtension(context.Background(), "pg_trgm")
+	if err != nil {
+		log.Error("Failed to check pg_trgm extension: ", err)
+	}
+	if !ps.trigram {
+		log.Warn("pg_trgm is not installed in prod DB, fallback search will not match misspelled names")
+	}
+
+	// fallback takes all search traffic while ES is down, without indexes every search would scan products
+	missing, err := db.missingSearchIndexes(context.Background(), ps.trigram)
+	if err != nil {
+		log.Error("Failed to check fallback search indexes: ", err)
+	} else if len(missing) > 0 {
+		log.Warn("Fallback search indexes ", missing, " are missing or invalid in prod DB, they are built by `crutch search-indexes`")
+	}
+
+	return &ps
+}
+
+// `crutch search-indexes` builds indexes of fallback search in prod DB, `crutch search-indexes -print` prints
+// their DDL instead, e.g. to add it to migrations of the main app; it is run once by hand rather than on start,
+// since building GIN indexes on product_product takes a while and loads prod DB
+func runSearchIndexes(args []string) error {
+	flags := flagset.NewFlagSet("search-indexes", flagset.ExitOnError)
+	printDDL := flags.Bool("print", false, "print DDL of indexes instead of building them")
+	flags.Parse(args)
+
+	prodDB, err := initProdDBFromEnv()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	trigram, err := prodDB.hasExtension(ctx, "pg_trgm")
+	if err != nil {
+		return fmt.Errorf("Failed to check pg_trgm extension: %v", err)
+	}
+	if !trigram {
+		log.Warn("pg_trgm is not installed in prod DB, trigram indexes are skipped")
+	}
+
+	if *printDDL {
+		for _, idx := range productSearchIndexes(trigram) {
+			fmt.Println(idx.ddl() + ";")
+		}
+		return nil
+	}
+	return prodDB.createSearchIndexes(ctx, trigram)
+}
+
+func (ps *postgresSearch) name() string {
+	return searchBackendPostgres
+}
+
+// cursor issued by ES still carries the page number, so paging goes on with offsets
+func (ps *postgresSearch) search(query *SearchQuery, stock *StockFilter, ctx context.Context) (*SearchPage, error) {
+	cursor, err := decodeCursor(query)
+	if err != nil {
+		return nil, err
+	}
+
+	sp := SearchPage{Page: query.Page, Backend: ps.name()}
+	if cursor != nil {
+		sp.Page = cursor.Page
+	}
+
+	ids, scores, total, err := ps.db.searchProductIds(ctx, query, stock, ps.trigram, itemsPerPage, sp.Page*itemsPerPage)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to search products in prod DB: %v", err)
+	}
+
+	sp.TotalPages = (total + itemsPerPage - 1) / itemsPerPage
+	sp.Hits = make([]interface{}, len(ids))
+	for i, id := range ids {
+		sp.Hits[i] = map[string]interface{}{"_id": strconv.Itoa(id), "_score": scores[i]}
+	}
+
+	return &sp, nil
+}
+
+func (ps *postgresSearch) correctSpelling(text string, ctx context.Context) (string, error) {
+	return "", nil
+}
+
+// sends searches to primary backend and fails over to fallback; after threshold consecutive failures
+// primary is skipped for cooldown, then one request at a time probes it until it succeeds
+type searchBreaker struct {
+	primary   searchBackend
+	fallback  searchBackend
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func initSearchBreaker(primary searchBackend, fallback searchBackend, threshold int, cooldown time.Duration) *searchBreaker {
+	return &searchBreaker{primary: primary, fallback: fallback, threshold: threshold, cooldown: cooldown}
+}
+
+func (b *searchBreaker) name() string {
+	return b.primary.name() + "/" + b.fallback.name()
+}
+
+func (b *searchBreaker) allowPrimary() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *searchBreaker) report(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	open := b.failures >= b.threshold
+	b.probing = false
+
+	if err == nil {
+		if open {
+			log.Info("Search backend ", b.primary.name(), " is back, circuit closed")
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		if !open {
+			log.Error("Search backend ", b.primary.name(), " failed ", b.failures, " times in a row, circuit opened for ", b.cooldown)
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// only transport errors and 5xx responses count as failures of backend
+func requestRejected(err error) bool {
+	var ee *elasticError
+	return errors.As(err, &ee) && ee.StatusCode < http.StatusInternalServerError
+}
+
+// cancelled request says nothing about backend, it only gives up probing
+func (b *searchBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *searchBreaker) search(query *SearchQuery, stock *StockFilter, ctx context.Context) (*SearchPage, error) {
+	if b.allowPrimary() {
+		sp, err := b.primary.search(query, stock, ctx)
+		switch {
+		case err == nil:
+			b.report(nil)
+			searchBackendResponses.Add(sp.Backend, 1)
+			return sp, nil
+		case err == errCursorExpired || requestRejected(err):
+			// backend is up, request is wrong
+			b.report(nil)
+			return nil, err
+		case ctx.Err() != nil:
+			b.release()
+			return nil, err
+		}
+		b.report(err)
+		log.Error("Search in ", b.primary.name(), " failed, falling back to ", b.fallback.name(), ": ", err)
+	}
+
+	sp, err := b.fallback.search(query, stock, ctx)
+	if err != nil {
+		return nil, err
+	}
+	searchBackendResponses.Add(sp.Backend, 1)
+	return sp, nil
+}
+
+// spelling is not corrected by primary while circuit is open, failures are counted by searches only
+func (b *searchBreaker) correctSpelling(text string, ctx context.Context) (string, error) {
+	b.mu.Lock()
+	open := b.failures >= b.threshold
+	b.mu.Unlock()
+
+	if open {
+		return b.fallback.correctSpelling(text, ctx)
+	}
+	return b.primary.correctSpelling(text, ctx)
+}
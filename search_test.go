@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type fakeBackend struct {
+	backend string
+	err     error
+	calls   int
+}
+
+func (fb *fakeBackend) name() string {
+	return fb.backend
+}
+
+func (fb *fakeBackend) search(query *SearchQuery, stock *StockFilter, ctx context.Context) (*SearchPage, error) {
+	fb.calls++
+	if fb.err != nil {
+		return nil, fb.err
+	}
+	return &SearchPage{Backend: fb.backend}, nil
+}
+
+func (fb *fakeBackend) correctSpelling(text string, ctx context.Context) (string, error) {
+	return "", fb.err
+}
+
+func TestSearchBreaker(t *testing.T) {
+	log.SetLevel(logrus.FatalLevel)
+
+	primary := &fakeBackend{backend: searchBackendElastic}
+	fallback := &fakeBackend{backend: searchBackendPostgres}
+	b := initSearchBreaker(primary, fallback, 2, time.Hour)
+
+	served := func() string {
+		sp, err := b.search(&SearchQuery{}, &StockFilter{}, context.Background())
+		if err != nil {
+			t.Fatalf("Search failed - %v", err)
+		}
+		return sp.Backend
+	}
+
+	if backend := served(); backend != searchBackendElastic {
+		t.Errorf("Healthy primary is not used, served by %s", backend)
+	}
+
+	primary.err = fmt.Errorf("connection refused")
+	for i := 0; i < 2; i++ {
+		if backend := served(); backend != searchBackendPostgres {
+			t.Errorf("Failed search is not retried in fallback, served by %s", backend)
+		}
+	}
+
+	primary.calls = 0
+	served()
+	if primary.calls != 0 {
+		t.Errorf("Primary is called while circuit is open")
+	}
+
+	// cooldown is over, one probe succeeds and closes the circuit
+	primary.err = nil
+	b.openUntil = time.Now()
+	if backend := served(); backend != searchBackendElastic {
+		t.Errorf("Primary is not probed after cooldown, served by %s", backend)
+	}
+	if b.failures != 0 {
+		t.Errorf("Circuit is not closed after successful probe")
+	}
+
+	// cursor expiration is answer of healthy backend
+	primary.err = errCursorExpired
+	if _, err := b.search(&SearchQuery{}, &StockFilter{}, context.Background()); err != errCursorExpired {
+		t.Errorf("Expired cursor error is not returned, got %v", err)
+	}
+	if b.failures != 0 {
+		t.Errorf("Expired cursor is counted as failure")
+	}
+
+	// bad request is not retried in fallback and does not open the circuit
+	for i := 0; i < 3; i++ {
+		primary.err = &elasticError{400, "[400 Bad Request] query_shard_exception"}
+		if _, err := b.search(&SearchQuery{}, &StockFilter{}, context.Background()); err != primary.err {
+			t.Errorf("Bad request error is not returned, got %v", err)
+		}
+	}
+	if b.failures != 0 {
+		t.Errorf("Bad request is counted as failure")
+	}
+
+	primary.err = &elasticError{503, "[503 Service Unavailable] no_shard_available_action_exception"}
+	if backend := served(); backend != searchBackendPostgres {
+		t.Errorf("Search is not retried in fallback after 5xx, served by %s", backend)
+	}
+	if b.failures != 1 {
+		t.Errorf("5xx response is not counted as failure")
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+type serviceAccountParams struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+type serviceAccountUpdateParams struct {
+	Enabled  *bool `json:"enabled"`
+	Password *bool `json:"password"`
+	Rotate   *bool `json:"rotate"` // keep previous password valid for grace period
+}
+
+// service accounts belong to the company of company admin, supplier takes precedence over contractor
+func serviceAccountCompany(userInfo UserInfo) (contractorId int, supplierId int, err error) {
+	if userInfo.SupplierId != 0 {
+		return 0, userInfo.SupplierId, nil
+	}
+	if userInfo.ContractorId != 0 {
+		return userInfo.ContractorId, 0, nil
+	}
+	return 0, 0, fmt.Errorf("User does not belong to any company")
+}
+
+func (mh *MethodHandlers) createServiceAccount(ctx context.Context, userInfo UserInfo, params serviceAccountParams) (sa *ServiceAccount, err error, code int) {
+
+	contractorId, supplierId, err := serviceAccountCompany(userInfo)
+	if err != nil {
+		return nil, err, http.StatusBadRequest
+	}
+
+	if params.Name == "" || utf8.RuneCountInString(params.Name) > 64 {
+		return nil, fmt.Errorf("Service account name must be non empty string up to 64 characters"), http.StatusBadRequest
+	}
+
+	if len(params.Scopes) == 0 {
+		return nil, fmt.Errorf("At least one scope is required, available scopes are %v", apiScopes), http.StatusBadRequest
+	}
+	for _, scope := range params.Scopes {
+		if !contains(apiScopes, scope) {
+			return nil, fmt.Errorf("Unknown scope %s, available scopes are %v", scope, apiScopes), http.StatusBadRequest
+		}
+	}
+
+	if params.ExpiresAt != nil && params.ExpiresAt.Before(time.Now()) {
+		return nil, fmt.Errorf("Expiry date %v is in the past", params.ExpiresAt), http.StatusBadRequest
+	}
+
+	companyName, err := mh.prodDB.getCompanyName(ctx, contractorId, supplierId)
+	if err != nil {
+		return nil, err, http.StatusInternalServerError
+	}
+
+	sa = &ServiceAccount{
+		Name:         params.Name,
+		Scopes:       params.Scopes,
+		ExpiresAt:    params.ExpiresAt,
+		ContractorId: contractorId,
+		SupplierId:   supplierId,
+		CreatedBy:    userInfo.Id,
+	}
+
+	err = mh.crutchDB.createServiceAccount(ctx, sa, companyName)
+	if err != nil {
+		return nil, err, http.StatusInternalServerError
+	}
+
+	log.Info("User ", userInfo.Id, " created service account ", sa.Login, " with scopes ", sa.Scopes)
+
+	return sa, nil, http.StatusCreated
+}
+
+func (mh *MethodHandlers) getServiceAccountsHandler(w http.ResponseWriter, r *http.Request) error {
+
+	userInfo := mh.getUserInfo(r)
+
+	contractorId, supplierId, err := serviceAccountCompany(userInfo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+
+	accounts, err := mh.crutchDB.getServiceAccounts(r.Context(), contractorId, supplierId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(struct {
+		ServiceAccounts []ServiceAccount `json:"serviceAccounts"`
+		Scopes          []string         `json:"scopes"`
+	}{accounts, apiScopes})
+
+	if err != nil {
+		err = fmt.Errorf("Error while preparing json reponse: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	return nil
+}
+
+func (mh *MethodHandlers) createServiceAccountHandler(w http.ResponseWriter, r *http.Request) error {
+
+	userInfo := mh.getUserInfo(r)
+
+	params := serviceAccountParams{}
+
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		err = fmt.Errorf("Failed to decode request body - %s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+
+	sa, err, code := mh.createServiceAccount(r.Context(), userInfo, params)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	err = json.NewEncoder(w).Encode(sa)
+
+	if err != nil {
+		err = fmt.Errorf("Error while preparing json reponse: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	return nil
+}
+
+// enables, disables or rotates password of service account
+func (mh *MethodHandlers) updateServiceAccountHandler(w http.ResponseWriter, r *http.Request) error {
+
+	userInfo := mh.getUserInfo(r)
+
+	contractorId, supplierId, err := serviceAccountCompany(userInfo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["accountId"])
+	if err != nil {
+		err = fmt.Errorf("Failed to determine service account ID: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+
+	params := serviceAccountUpdateParams{}
+
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		err = fmt.Errorf("Failed to decode request body - %s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+
+	rotatePassword := params.Password != nil && *params.Password
+	var gracePeriod time.Duration
+	if params.Rotate != nil && *params.Rotate {
+		gracePeriod = mh.passwordGracePeriod
+	}
+
+	sa, err := mh.crutchDB.updateServiceAccount(r.Context(), contractorId, supplierId, id, params.Enabled, rotatePassword, gracePeriod)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return err
+	}
+
+	mh.userCache.invalidateApiLogin(sa.Login)
+
+	log.Info("User ", userInfo.Id, " updated service account ", sa.Login, ", enabled ", sa.Enabled, ", new password ", rotatePassword)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(sa)
+
+	if err != nil {
+		err = fmt.Errorf("Error while preparing json reponse: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	return nil
+}
+
+func (mh *MethodHandlers) revokeServiceAccountHandler(w http.ResponseWriter, r *http.Request) error {
+
+	userInfo := mh.getUserInfo(r)
+
+	contractorId, supplierId, err := serviceAccountCompany(userInfo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["accountId"])
+	if err != nil {
+		err = fmt.Errorf("Failed to determine service account ID: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+
+	login, err := mh.crutchDB.revokeServiceAccount(r.Context(), contractorId, supplierId, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return err
+	}
+
+	mh.userCache.invalidateApiLogin(login)
+
+	log.Info("User ", userInfo.Id, " revoked service account ", login)
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crypto_rand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// signed requests carry header "Authorization: IM-HMAC-SHA256 KeyId=<api login>, Timestamp=<unix seconds>, Nonce=<random>, Signature=<hex>",
+// signature is HMAC-SHA256 with signing secret of API login over lines
+// method, path, canonical (sorted) query, timestamp, nonce and hex encoded SHA-256 of body joined with \n
+const (
+	signatureScheme     = "IM-HMAC-SHA256"
+	authMethodSignature = "signature"
+	maxSignedBodySize   = 10 << 20
+)
+
+// signing secrets are kept in crutch DB encrypted with server key, since
+// unlike passwords they are needed in plain form to verify signature
+type requestSigner struct {
+	crutchDB *CrutchDBHelper
+	aead     cipher.AEAD
+	maxSkew  time.Duration
+}
+
+// empty key disables signed requests
+func initRequestSigner(crutchDB *CrutchDBHelper, key string, maxSkew string) (*requestSigner, error) {
+	rs := requestSigner{crutchDB: crutchDB}
+
+	var err error
+	rs.maxSkew, err = time.ParseDuration(maxSkew)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse signature clock skew: %v", err)
+	}
+	if rs.maxSkew <= 0 {
+		return nil, fmt.Errorf("Signature clock skew must be positive, got %v", rs.maxSkew)
+	}
+
+	if key == "" {
+		log.Warn("SIGNING_KEY is not set, signed requests are disabled")
+		return &rs, nil
+	}
+
+	keyBytes, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode signing key: %v", err)
+	}
+
+	block, err := aes.NewCipher(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Signing key must be base64 encoded 16, 24 or 32 bytes: %v", err)
+	}
+
+	rs.aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// nonces older than skew window can not be replayed anyway
+	go func() {
+		for range time.Tick(rs.maxSkew) {
+			err := crutchDB.deleteNoncesBefore(context.Background(), time.Now().Add(-2*rs.maxSkew))
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+
+	return &rs, nil
+}
+
+func (rs *requestSigner) enabled() bool {
+	return rs.aead != nil
+}
+
+func (rs *requestSigner) encryptSecret(secret []byte) ([]byte, error) {
+	nonce := make([]byte, rs.aead.NonceSize())
+	if _, err := crypto_rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return rs.aead.Seal(nonce, nonce, secret, nil), nil
+}
+
+func (rs *requestSigner) decryptSecret(encrypted []byte) ([]byte, error) {
+	if len(encrypted) < rs.aead.NonceSize() {
+		return nil, fmt.Errorf("Encrypted signing secret is too short")
+	}
+	nonce := encrypted[:rs.aead.NonceSize()]
+	return rs.aead.Open(nil, nonce, encrypted[rs.aead.NonceSize():], nil)
+}
+
+// generates new secret, returns it in plain form to be shown once and encrypted to be stored
+func (rs *requestSigner) generateSecret() (string, []byte, error) {
+	b := make([]byte, 32)
+	if _, err := crypto_rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+
+	encrypted, err := rs.encryptSecret([]byte(secret))
+	return secret, encrypted, err
+}
+
+type requestSignature struct {
+	KeyId        string
+	Timestamp    time.Time
+	RawTimestamp string // signed as sent by client
+	Nonce        string
+	Signature    []byte
+}
+
+func isSignedRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), signatureScheme+" ")
+}
+
+func parseSignatureHeader(header string) (*requestSignature, error) {
+	params := map[string]string{}
+	for _, part := range strings.Split(strings.TrimPrefix(header, signatureScheme+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = kv[1]
+		}
+	}
+
+	sig := requestSignature{KeyId: params["KeyId"], Nonce: params["Nonce"], RawTimestamp: params["Timestamp"]}
+	if sig.KeyId == "" || sig.Nonce == "" || len(sig.Nonce) > 64 {
+		return nil, fmt.Errorf("Signature header must contain KeyId and Nonce up to 64 characters")
+	}
+
+	ts, err := strconv.ParseInt(sig.RawTimestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid signature timestamp: %v", err)
+	}
+	sig.Timestamp = time.Unix(ts, 0)
+
+	sig.Signature, err = hex.DecodeString(params["Signature"])
+	if err != nil || len(sig.Signature) == 0 {
+		return nil, fmt.Errorf("Signature must be hex encoded")
+	}
+
+	return &sig, nil
+}
+
+func stringToSign(r *http.Request, timestamp string, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.Query().Encode(),
+		timestamp,
+		nonce,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+}
+
+// client clock may be either ahead or behind of server one
+func withinSkew(timestamp time.Time, now time.Time, maxSkew time.Duration) bool {
+	skew := now.Sub(timestamp)
+	return skew <= maxSkew && skew >= -maxSkew
+}
+
+func computeSignature(secret []byte, s string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+func signatureFailed(w http.ResponseWriter, err error, status int) error {
+	log.Error(err)
+	w.Header().Set("WWW-Authenticate", signatureScheme)
+	http.Error(w, err.Error(), status)
+	return err
+}
+
+func (auth *AuthMiddleware) checkSignature(w http.ResponseWriter, r *http.Request) (*UserInfo, error) {
+	rs := auth.signer
+	if !rs.enabled() {
+		return nil, signatureFailed(w, fmt.Errorf("Signed requests are not enabled"), http.StatusUnauthorized)
+	}
+
+	sig, err := parseSignatureHeader(r.Header.Get("Authorization"))
+	if err != nil {
+		return nil, signatureFailed(w, err, http.StatusUnauthorized)
+	}
+
+	if !withinSkew(sig.Timestamp, time.Now(), rs.maxSkew) {
+		return nil, signatureFailed(w, fmt.Errorf("Signature timestamp differs from server time by more than %v", rs.maxSkew), http.StatusUnauthorized)
+	}
+
+	ip := clientIP(r)
+
+	lockedUntil, failures, err := auth.crutchDB.getAuthLock(r.Context(), sig.KeyId, ip)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+	if lockedUntil != nil {
+		err = fmt.Errorf("Too many failed attempts, API login %s is locked until %v", sig.KeyId, lockedUntil.Format(time.RFC3339))
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(*lockedUntil).Seconds())+1))
+		return nil, signatureFailed(w, err, http.StatusTooManyRequests)
+	}
+
+	// one byte over the limit tells truncated body from body of exactly maxSignedBodySize
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBodySize+1))
+	if err != nil {
+		return nil, signatureFailed(w, fmt.Errorf("Failed to read request body: %v", err), http.StatusBadRequest)
+	}
+	if len(body) > maxSignedBodySize {
+		return nil, signatureFailed(w, fmt.Errorf("Signed request body must not exceed %d bytes", maxSignedBodySize), http.StatusRequestEntityTooLarge)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	creds, err := auth.crutchDB.getUserCredsFromApiLogin(r.Context(), sig.KeyId)
+
+	var secret []byte
+	var userId *int
+	if err == nil && creds.SigningSecret != nil {
+		if creds.UserId != 0 {
+			userId = &creds.UserId
+		}
+		secret, err = rs.decryptSecret(creds.SigningSecret)
+		if err != nil {
+			log.Error("Failed to decrypt signing secret of ", sig.KeyId, ": ", err)
+		}
+	}
+
+	expected := computeSignature(secret, stringToSign(r, sig.RawTimestamp, sig.Nonce, body))
+	if secret == nil || !hmac.Equal(expected, sig.Signature) {
+		auth.registerBasicAuthFailure(r.Context(), sig.KeyId, ip, userId)
+		return nil, signatureFailed(w, fmt.Errorf("Wrong API key or signature"), http.StatusUnauthorized)
+	}
+
+	ui := creds.userInfo(authMethodSignature, sig.KeyId)
+	err = auth.checkAllowedIP(w, r, ui)
+	if err != nil {
+		return nil, err
+	}
+
+	// nonce is saved only for valid signatures, so that it can not be used to block legitimate requests
+	err = auth.crutchDB.saveNonce(r.Context(), sig.KeyId, sig.Nonce)
+	if err != nil {
+		return nil, signatureFailed(w, err, http.StatusUnauthorized)
+	}
+
+	if failures > 0 {
+		err = auth.crutchDB.resetAuthFailures(r.Context(), authFailureKindLogin, sig.KeyId)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+
+	log.Info("Signature: userId ", creds.UserId, ", login ", sig.KeyId)
+	return ui, nil
+}
+
+// issues new signing secret for API key, secret is shown only in this response
+func (mh *MethodHandlers) createSigningSecretHandler(w http.ResponseWriter, r *http.Request) error {
+
+	userInfo := mh.getUserInfo(r)
+
+	keyId, err := strconv.Atoi(mux.Vars(r)["keyId"])
+	if err != nil {
+		err = fmt.Errorf("Failed to determine API key ID: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+
+	login, secret, err, code := mh.createSigningSecret(r.Context(), userInfo, keyId)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(struct {
+		KeyId         string `json:"keyId"`
+		SigningSecret string `json:"signingSecret"`
+	}{login, secret})
+
+	if err != nil {
+		err = fmt.Errorf("Error while preparing json reponse: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	return nil
+}
+
+// keyId 0 means default API credentials of the user
+func (mh *MethodHandlers) createSigningSecret(ctx context.Context, userInfo UserInfo, keyId int) (login string, secret string, err error, code int) {
+	if !mh.signer.enabled() {
+		return "", "", fmt.Errorf("Signed requests are not enabled on this server"), http.StatusNotImplemented
+	}
+
+	secret, encrypted, err := mh.signer.generateSecret()
+	if err != nil {
+		return "", "", err, http.StatusInternalServerError
+	}
+
+	login, err = mh.crutchDB.setApiSigningSecret(ctx, userInfo, keyId, encrypted)
+	if err != nil {
+		return "", "", err, http.StatusNotFound
+	}
+
+	log.Info("User ", userInfo.Id, " issued signing secret for ", login)
+
+	return login, secret, nil, http.StatusOK
+}
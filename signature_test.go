@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStringToSign(t *testing.T) {
+	emptyHash := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	tests := []struct {
+		method string
+		target string
+		body   string
+		want   string
+	}{
+		{"GET", "/api/v1/products", "", "GET\n/api/v1/products\n\n1700000000\nabc\n" + emptyHash},
+		// query is sorted by key, so clients do not have to keep order of parameters
+		{"GET", "/api/v1/products?text=bolt&page=2&cityId=1", "", "GET\n/api/v1/products\ncityId=1&page=2&text=bolt\n1700000000\nabc\n" + emptyHash},
+		{"GET", "/api/v1/products?text=%D0%B1%D0%BE%D0%BB%D1%82+M10", "", "GET\n/api/v1/products\ntext=%D0%B1%D0%BE%D0%BB%D1%82+M10\n1700000000\nabc\n" + emptyHash},
+		{"GET", "/api/v1/products/a%2Fb", "", "GET\n/api/v1/products/a%2Fb\n\n1700000000\nabc\n" + emptyHash},
+		{"POST", "/api/v1/products/lookup", `{"items":[]}`, "POST\n/api/v1/products/lookup\n\n1700000000\nabc\neef46741adfc3a9f76294d3b78f37a45f113092ac9d44ee77c7a038a88ff09a1"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		if got := stringToSign(r, "1700000000", "abc", []byte(tt.body)); got != tt.want {
+			t.Errorf("stringToSign(%s %s) = %q, want %q", tt.method, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestComputeSignature(t *testing.T) {
+	// RFC 4231, test case 2
+	got := hex.EncodeToString(computeSignature([]byte("Jefe"), "what do ya want for nothing?"))
+	want := "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+	if got != want {
+		t.Errorf("computeSignature() = %s, want %s", got, want)
+	}
+}
+
+func TestParseSignatureHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		valid  bool
+	}{
+		{"IM-HMAC-SHA256 KeyId=erp, Timestamp=1700000000, Nonce=abc, Signature=0a1b", true},
+		{"IM-HMAC-SHA256 Signature=0a1b,Nonce=abc,Timestamp=1700000000,KeyId=erp", true},
+		{"IM-HMAC-SHA256 Timestamp=1700000000, Nonce=abc, Signature=0a1b", false},
+		{"IM-HMAC-SHA256 KeyId=erp, Timestamp=1700000000, Signature=0a1b", false},
+		{"IM-HMAC-SHA256 KeyId=erp, Timestamp=yesterday, Nonce=abc, Signature=0a1b", false},
+		{"IM-HMAC-SHA256 KeyId=erp, Timestamp=1700000000, Nonce=abc, Signature=xyz", false},
+		{"IM-HMAC-SHA256 KeyId=erp, Timestamp=1700000000, Nonce=abc, Signature=", false},
+		{"IM-HMAC-SHA256 KeyId=erp, Timestamp=1700000000, Nonce=" + strings.Repeat("a", 65) + ", Signature=0a1b", false},
+	}
+
+	for _, tt := range tests {
+		sig, err := parseSignatureHeader(tt.header)
+		if (err == nil) != tt.valid {
+			t.Errorf("parseSignatureHeader(%q) error = %v, want valid %v", tt.header, err, tt.valid)
+			continue
+		}
+		if !tt.valid {
+			continue
+		}
+		if sig.KeyId != "erp" || sig.Nonce != "abc" || sig.RawTimestamp != "1700000000" || !sig.Timestamp.Equal(time.Unix(1700000000, 0)) {
+			t.Errorf("parseSignatureHeader(%q) = %+v", tt.header, sig)
+		}
+	}
+}
+
+func TestWithinSkew(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		timestamp time.Time
+		want      bool
+	}{
+		{now, true},
+		{now.Add(-5 * time.Minute), true},
+		{now.Add(5 * time.Minute), true},
+		{now.Add(-5*time.Minute - time.Second), false},
+		{now.Add(5*time.Minute + time.Second), false},
+		{time.Unix(0, 0), false},
+	}
+
+	for _, tt := range tests {
+		if got := withinSkew(tt.timestamp, now, 5*time.Minute); got != tt.want {
+			t.Errorf("withinSkew(%v) = %v, want %v", tt.timestamp, got, tt.want)
+		}
+	}
+}
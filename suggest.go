@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// suggestions are requested on every keystroke, so they come from ES only,
+// without Postgres enrichment, and are cut off by suggestTimeout
+const (
+	suggestTimeout       = 300 * time.Millisecond
+	suggestSize          = 5
+	suggestMinLength     = 2
+	suggestMaxExpansions = 20
+)
+
+type Suggestion struct {
+	Text      string `json:"text"`
+	ProductId int    `json:"productId,omitempty"`
+}
+
+type Suggestions struct {
+	Names      []Suggestion `json:"names"`
+	Codes      []Suggestion `json:"codes"`
+	Categories []Suggestion `json:"categories"`
+}
+
+func emptySuggestions() *Suggestions {
+	return &Suggestions{make([]Suggestion, 0), make([]Suggestion, 0), make([]Suggestion, 0)}
+}
+
+// only products search would show to the user are suggested, filters come from StockFilter
+func phrasePrefixQuery(field string, text string, filters []interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"must": map[string]interface{}{
+				"match_phrase_prefix": map[string]interface{}{
+					field: map[string]interface{}{
+						"query":          text,
+						"max_expansions": suggestMaxExpansions,
+					},
+				},
+			},
+			"filter": filters,
+		},
+	}
+}
+
+// names, codes and categories are queried in one multi search request
+func (es *ElasticHelper) suggest(text string, stock *StockFilter, ctx context.Context) (*Suggestions, error) {
+
+	suggestions := emptySuggestions()
+	if utf8.RuneCountInString(text) < suggestMinLength {
+		return suggestions, nil
+	}
+
+	timeout := strconv.FormatInt(suggestTimeout.Milliseconds(), 10) + "ms"
+	filters := es.stockFilters(stock)
+	queries := []map[string]interface{}{
+		{
+			// several products often share the name, so more hits are requested to fill the list
+			"size":    suggestSize * 4,
+			"_source": []string{"name"},
+			"query":   phrasePrefixQuery("name", text, filters),
+			"timeout": timeout,
+		},
+		{
+			"size":    suggestSize,
+			"_source": []string{"code"},
+			"query":   phrasePrefixQuery("code", text, filters),
+			"timeout": timeout,
+		},
+		{
+			"size":    0,
+			"query":   phrasePrefixQuery("category.name", text, filters),
+			"aggs":    map[string]interface{}{"categories": termsAggregation(categoryFacetField, suggestSize*4, nil)},
+			"timeout": timeout,
+		},
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, q := range queries {
+		if err := encoder.Encode(map[string]interface{}{"index": productIndex}); err != nil {
+			return nil, fmt.Errorf("Error encoding query: %v", err)
+		}
+		if err := encoder.Encode(q); err != nil {
+			return nil, fmt.Errorf("Error encoding query: %v", err)
+		}
+	}
+
+	log.Debug("Quering elastic for suggestions: ", buf.String())
+
+	res, err := es.client.Msearch(
+		&buf,
+		es.client.Msearch.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting response: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("Suggest request failed: %s", res.Status())
+	}
+
+	var response struct {
+		Responses []map[string]interface{} `json:"responses"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("Error parsing elastic response: %v", err)
+	}
+
+	if len(response.Responses) != len(queries) {
+		return nil, fmt.Errorf("Elastic returned %d responses for %d suggest queries", len(response.Responses), len(queries))
+	}
+	for _, r := range response.Responses {
+		if r["error"] != nil {
+			return nil, fmt.Errorf("Suggest query failed: %v", r["error"])
+		}
+	}
+
+	suggestions.Names = hitSuggestions(response.Responses[0], "name")
+	suggestions.Codes = hitSuggestions(response.Responses[1], "code")
+
+	// products have several categories, only ones matching the text are suggested
+	prefix := strings.ToLower(strings.Fields(text)[0])
+	raw, _ := aggregation(response.Responses[2], "aggregations", "categories")["buckets"].([]interface{})
+	for _, b := range raw {
+		bucket, _ := b.(map[string]interface{})
+		category := fmt.Sprint(bucket["key"])
+		if strings.Contains(strings.ToLower(category), prefix) && len(suggestions.Categories) < suggestSize {
+			suggestions.Categories = append(suggestions.Categories, Suggestion{Text: category})
+		}
+	}
+
+	return suggestions, nil
+}
+
+// distinct values of field from hits, up to suggestSize
+func hitSuggestions(response map[string]interface{}, field string) []Suggestion {
+	suggestions := make([]Suggestion, 0)
+	seen := make(map[string]bool)
+
+	hits, _ := aggregation(response, "hits")["hits"].([]interface{})
+	for _, hit := range hits {
+		h, _ := hit.(map[string]interface{})
+		text, _ := aggregation(h, "_source")[field].(string)
+		if text == "" || seen[strings.ToLower(text)] {
+			continue
+		}
+		seen[strings.ToLower(text)] = true
+
+		id, _ := strconv.Atoi(fmt.Sprint(h["_id"]))
+		suggestions = append(suggestions, Suggestion{text, id})
+		if len(suggestions) == suggestSize {
+			break
+		}
+	}
+
+	return suggestions
+}
+
+func (mh *MethodHandlers) suggestProductsHandler(w http.ResponseWriter, r *http.Request) error {
+
+	userInfo := mh.getUserInfo(r)
+	text := strings.TrimSpace(r.URL.Query().Get("text"))
+
+	// cities are cached, so prod DB is queried once per user, not on every keystroke
+	cities, err, status := mh.getSearchCities(r.Context(), userInfo)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), suggestTimeout)
+	defer cancel()
+
+	suggestions, err := mh.es.suggest(text, newStockFilter(userInfo, cities, &SearchQuery{}), ctx)
+	if err != nil {
+		if ctx.Err() != context.DeadlineExceeded {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+		// late suggestions are useless, user has already typed further
+		log.Warn("Suggestions for '", text, "' took longer than ", suggestTimeout)
+		suggestions = emptySuggestions()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(suggestions)
+	if err != nil {
+		err = fmt.Errorf("Error while preparing json reponse: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	return nil
+}
+
+// searches with fewer entries than that are checked for misspellings
+const fewSearchResults = 5
+
+// sub-field of name and description with unstemmed shingles, see conf/elastic/product_index.json
+const shingleSuffix = ".shingle"
+
+type phraseSuggestion struct {
+	Options []struct {
+		Text  string  `json:"text"`
+		Score float64 `json:"score"`
+	} `json:"options"`
+}
+
+// suggestions are built from unstemmed shingles, stemmed field is only used to check they find something
+func phraseSuggester(field string, mapping productMapping) map[string]interface{} {
+	suggestField := field
+	if mapping.Shingles {
+		suggestField = field + shingleSuffix
+	}
+	return map[string]interface{}{
+		"phrase": map[string]interface{}{
+			"field":      suggestField,
+			"size":       1,
+			"max_errors": 2,
+			"direct_generator": []interface{}{
+				map[string]interface{}{"field": suggestField, "suggest_mode": "always", "min_word_length": 3},
+			},
+			// only corrections which find something are returned
+			"collate": map[string]interface{}{
+				"query": map[string]interface{}{
+					"source": map[string]interface{}{
+						"match": map[string]interface{}{
+							"{{field_name}}": map[string]interface{}{"query": "{{suggestion}}", "operator": "and"},
+						},
+					},
+				},
+				"params": map[string]interface{}{"field_name": field},
+			},
+		},
+	}
+}
+
+// corrected text with the best score among name and description suggesters, empty if nothing better is found
+func (es *ElasticHelper) correctSpelling(text string, ctx context.Context) (string, error) {
+
+	mapping := es.productMapping()
+	var buf bytes.Buffer
+	q := map[string]interface{}{
+		"size": 0,
+		"suggest": map[string]interface{}{
+			"text":        text,
+			"name":        phraseSuggester("name", mapping),
+			"description": phraseSuggester("description", mapping),
+		},
+	}
+
+	if err := json.NewEncoder(&buf).Encode(q); err != nil {
+		return "", fmt.Errorf("Error encoding query: %v", err)
+	}
+
+	res, err := es.client.Search(
+		es.client.Search.WithContext(ctx),
+		es.client.Search.WithIndex(productIndex),
+		es.client.Search.WithBody(&buf),
+	)
+	if err != nil {
+		return "", fmt.Errorf("Error getting response: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return "", fmt.Errorf("Spelling suggest request failed: %s", res.Status())
+	}
+
+	var response struct {
+		Suggest map[string][]phraseSuggestion `json:"suggest"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return "", fmt.Errorf("Error parsing elastic response: %v", err)
+	}
+
+	corrected, bestScore := "", 0.0
+	for _, suggestions := range response.Suggest {
+		for _, s := range suggestions {
+			for _, option := range s.Options {
+				if option.Score > bestScore && !strings.EqualFold(option.Text, text) {
+					corrected, bestScore = option.Text, option.Score
+				}
+			}
+		}
+	}
+
+	log.Debug("Spelling correction for '", text, "': '", corrected, "', score ", bestScore)
+
+	return corrected, nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	crypto_rand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	gorilla_context "github.com/gorilla/context"
+)
+
+// access token carries complete user info, so that requests with bearer token
+// are served without going to prod DB; only version of API credentials is checked,
+// so that revoking, disabling or changing them invalidates tokens already issued
+type accessTokenClaims struct {
+	User    UserInfo `json:"usr"`
+	Version int64    `json:"ver"`
+	jwt.RegisteredClaims
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type tokenConfig struct {
+	secret          []byte
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
+}
+
+func initTokenConfig(secret string, accessTokenTTL string, refreshTokenTTL string) (*tokenConfig, error) {
+	tc := tokenConfig{secret: []byte(secret)}
+
+	if secret == "" {
+		log.Warn("JWT_SECRET is not set, issued tokens will become invalid after restart")
+		tc.secret = make([]byte, 32)
+		if _, err := crypto_rand.Read(tc.secret); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	tc.accessTokenTTL, err = time.ParseDuration(accessTokenTTL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse access token TTL: %v", err)
+	}
+
+	tc.refreshTokenTTL, err = time.ParseDuration(refreshTokenTTL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse refresh token TTL: %v", err)
+	}
+
+	return &tc, nil
+}
+
+func (tc *tokenConfig) issueAccessToken(ui UserInfo) (string, error) {
+	now := time.Now()
+	claims := accessTokenClaims{
+		User:    ui,
+		Version: ui.CredentialsVersion,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.Itoa(ui.Id),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(tc.accessTokenTTL)),
+		},
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(tc.secret)
+}
+
+func (tc *tokenConfig) parseAccessToken(token string) (*UserInfo, error) {
+	claims := accessTokenClaims{}
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("Unexpected signing method %v", t.Header["alg"])
+		}
+		return tc.secret, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Invalid access token: %v", err)
+	}
+
+	claims.User.CredentialsVersion = claims.Version
+	return &claims.User, nil
+}
+
+func generateRefreshToken() (token string, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err = crypto_rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashRefreshToken(token), nil
+}
+
+// refresh tokens are random, so there is no need in slow hash
+func hashRefreshToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:]), true
+	}
+	return "", false
+}
+
+func (auth *AuthMiddleware) checkBearerToken(w http.ResponseWriter, r *http.Request, token string) (*UserInfo, error) {
+	ui, err := auth.tokens.parseAccessToken(token)
+	if err != nil {
+		log.Error(err)
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, err
+	}
+
+	ui.AuthMethod = authMethodBearer
+
+	err = auth.checkCredentialsVersion(r.Context(), ui)
+	if err != nil {
+		log.Error(err)
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, err
+	}
+
+	err = auth.checkAllowedIP(w, r, ui)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("Bearer: userId ", ui.Id, ", login ", ui.ApiLogin)
+	gorilla_context.Set(r, "UserInfo", *ui)
+
+	return ui, nil
+}
+
+// credentials version is cached as user info is, so revocation applies with the same bounded delay
+func (auth *AuthMiddleware) checkCredentialsVersion(ctx context.Context, ui *UserInfo) error {
+	version, found := auth.cache.getCredentialsVersion(ui.ApiLogin)
+	if !found {
+		var err error
+		version, err = auth.crutchDB.getApiCredentialsVersion(ctx, ui.ApiLogin)
+		if err != nil {
+			return fmt.Errorf("API login %s is not valid anymore", ui.ApiLogin)
+		}
+		auth.cache.setCredentialsVersion(*ui, version)
+	}
+
+	if version != ui.CredentialsVersion {
+		return fmt.Errorf("API credentials of %s have changed, access token is revoked", ui.ApiLogin)
+	}
+	return nil
+}
+
+// token endpoint, exchanges API credentials (grant_type=client_credentials with basic auth)
+// or refresh token (grant_type=refresh_token) for access token and new refresh token
+// @Summary Issue access token
+// @Description Exchanges API credentials (grant_type=client_credentials with basic auth) or refresh token (grant_type=refresh_token) for bearer access token and new refresh token. Refresh token is accepted only once, access token stops working when API credentials change.
+// @Tags auth
+// @Accept  x-www-form-urlencoded
+// @Produce  json
+// @Param grant_type formData string true "Grant type" Enums(client_credentials, refresh_token)
+// @Param refresh_token formData string false "Refresh token, required for refresh_token grant"
+// @Success 200 {object} tokenResponse
+// @Security BasicAuth
+// @Router /token [post]
+func (auth *AuthMiddleware) tokenHandler(w http.ResponseWriter, r *http.Request) error {
+
+	err := r.ParseForm()
+	if err != nil {
+		err = fmt.Errorf("Failed to parse request: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+
+	var ui *UserInfo
+	switch r.PostForm.Get("grant_type") {
+	case "client_credentials":
+		ui, err = auth.checkBasicAuth(w, r)
+		if err != nil {
+			return err
+		}
+
+	case "refresh_token":
+		ui, err = auth.useRefreshToken(r.Context(), r.PostForm.Get("refresh_token"))
+		if err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return err
+		}
+
+		err = auth.checkAllowedIP(w, r, ui)
+		if err != nil {
+			return err
+		}
+
+	default:
+		err = fmt.Errorf("Unsupported grant_type, expected client_credentials or refresh_token")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+
+	// blocked and not verified users do not get tokens, so cache is not used here
+	err = auth.loadUserInfo(w, r, ui, false)
+	if err != nil {
+		return err
+	}
+
+	accessToken, err := auth.tokens.issueAccessToken(*ui)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	refreshToken, refreshTokenHash, err := generateRefreshToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	err = auth.crutchDB.saveRefreshToken(r.Context(), refreshTokenHash, ui.Id, ui.ApiLogin, time.Now().Add(auth.tokens.refreshTokenTTL))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(tokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(auth.tokens.accessTokenTTL.Seconds()),
+		RefreshToken: refreshToken,
+	})
+
+	if err != nil {
+		err = fmt.Errorf("Error while preparing json reponse: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	return nil
+}
+
+// refresh token is used only once, API login it was issued for must still be valid
+func (auth *AuthMiddleware) useRefreshToken(ctx context.Context, token string) (*UserInfo, error) {
+	if token == "" {
+		return nil, fmt.Errorf("refresh_token is required")
+	}
+
+	userId, login, err := auth.crutchDB.consumeRefreshToken(ctx, hashRefreshToken(token))
+	if err != nil {
+		return nil, fmt.Errorf("Refresh token is invalid or expired")
+	}
+
+	creds, err := auth.crutchDB.getUserCredsFromApiLogin(ctx, login)
+	if err != nil || creds.UserId != userId {
+		return nil, fmt.Errorf("API login %s is not valid anymore", login)
+	}
+
+	log.Info("Refresh token: userId ", userId, ", login ", login)
+	return creds.userInfo(authMethodBearer, login), nil
+}
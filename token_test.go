@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// versions are preloaded into cache, so crutch DB is not needed
+func TestAccessTokenCredentialsVersion(t *testing.T) {
+	tc, err := initTokenConfig("secret", "15m", "720h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := AuthMiddleware{cache: initUserInfoCache(time.Minute), tokens: tc}
+
+	token, err := tc.issueAccessToken(UserInfo{Id: 1, ApiLogin: "erp", CredentialsVersion: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ui, err := tc.parseAccessToken(token)
+	if err != nil || ui.CredentialsVersion != 100 {
+		t.Fatalf("parseAccessToken() = %+v, %v", ui, err)
+	}
+
+	auth.cache.setCredentialsVersion(*ui, 100)
+	if err := auth.checkCredentialsVersion(context.Background(), ui); err != nil {
+		t.Errorf("Token of unchanged credentials is rejected: %v", err)
+	}
+
+	// password rotated
+	auth.cache.setCredentialsVersion(*ui, 200)
+	if err := auth.checkCredentialsVersion(context.Background(), ui); err == nil {
+		t.Errorf("Token of changed credentials is accepted")
+	}
+}
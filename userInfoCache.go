@@ -0,0 +1,164 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	userInfoCacheHits   = expvar.NewInt("user_info_cache_hits")
+	userInfoCacheMisses = expvar.NewInt("user_info_cache_misses")
+)
+
+type userInfoCacheEntry struct {
+	userInfo UserInfo
+	cities   []City // for entries of search cities
+	version  int64  // for entries of API credentials versions
+	expires  time.Time
+}
+
+// keeps user info loaded from prod DB, keyed by session key or API login;
+// entries live no longer than ttl, so changes like blocking user are applied with bounded delay
+type UserInfoCache struct {
+	ttl     time.Duration
+	mutex   sync.Mutex
+	entries map[string]userInfoCacheEntry
+}
+
+func initUserInfoCache(ttl time.Duration) *UserInfoCache {
+	c := UserInfoCache{ttl: ttl, entries: make(map[string]userInfoCacheEntry)}
+
+	if ttl > 0 {
+		go func() {
+			for range time.Tick(ttl) {
+				c.removeExpired()
+			}
+		}()
+	}
+
+	return &c
+}
+
+func sessionCacheKey(sessionKey string) string {
+	return "session:" + sessionKey
+}
+
+func apiLoginCacheKey(login string) string {
+	return "api:" + login
+}
+
+func credentialsVersionCacheKey(login string) string {
+	return "version:" + login
+}
+
+// cities depend on company of user, service accounts have no user id
+func citiesCacheKey(ui UserInfo) string {
+	return fmt.Sprintf("cities:%d:%d:%d:%t", ui.Id, ui.ContractorId, ui.SupplierId, ui.ServiceAccount)
+}
+
+// cities search filters products by, kept with the same ttl as user info, so that
+// suggestions typed on every keystroke do not query prod DB
+func (c *UserInfoCache) getCities(ui UserInfo) ([]City, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, found := c.entries[citiesCacheKey(ui)]
+	if !found || entry.expires.Before(time.Now()) {
+		return nil, false
+	}
+	return entry.cities, true
+}
+
+func (c *UserInfoCache) setCities(ui UserInfo, cities []City) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries[citiesCacheKey(ui)] = userInfoCacheEntry{ui, cities, 0, time.Now().Add(c.ttl)}
+}
+
+// version of API credentials bearer tokens are checked against, kept with the same ttl as user info
+func (c *UserInfoCache) getCredentialsVersion(login string) (int64, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, found := c.entries[credentialsVersionCacheKey(login)]
+	if !found || entry.expires.Before(time.Now()) {
+		return 0, false
+	}
+	return entry.version, true
+}
+
+// user id is kept, so that invalidateUser drops versions of their API keys too
+func (c *UserInfoCache) setCredentialsVersion(ui UserInfo, version int64) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries[credentialsVersionCacheKey(ui.ApiLogin)] = userInfoCacheEntry{UserInfo{Id: ui.Id, ServiceAccount: ui.ServiceAccount}, nil, version, time.Now().Add(c.ttl)}
+}
+
+func (c *UserInfoCache) get(key string) (UserInfo, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, found := c.entries[key]
+	if !found || entry.expires.Before(time.Now()) {
+		userInfoCacheMisses.Add(1)
+		return UserInfo{}, false
+	}
+
+	userInfoCacheHits.Add(1)
+	return entry.userInfo, true
+}
+
+func (c *UserInfoCache) set(key string, ui UserInfo) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries[key] = userInfoCacheEntry{ui, nil, 0, time.Now().Add(c.ttl)}
+}
+
+// drops all entries of the user, both sessions and API logins
+func (c *UserInfoCache) invalidateUser(userId int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key, entry := range c.entries {
+		if entry.userInfo.Id == userId {
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (c *UserInfoCache) invalidateApiLogin(login string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.entries, apiLoginCacheKey(login))
+	delete(c.entries, credentialsVersionCacheKey(login))
+}
+
+func (c *UserInfoCache) removeExpired() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	for key, entry := range c.entries {
+		if entry.expires.Before(now) {
+			delete(c.entries, key)
+		}
+	}
+}